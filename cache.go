@@ -0,0 +1,78 @@
+package consistentHash
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lookupCache is a bounded LRU cache of the nodes of names, each entry
+// remembers the version of the snapshot it was looked up in and is only
+// used while that snapshot is the current one
+type lookupCache struct {
+	mu    sync.Mutex
+	size  int
+	items map[string]*list.Element
+	order *list.List
+}
+
+// cacheEntry: a cached lookup, the element values of lookupCache.order
+type cacheEntry struct {
+	name    string
+	node    string
+	version uint64
+}
+
+// newLookupCache: create a cache of at most size names
+func newLookupCache(size int) *lookupCache {
+	return &lookupCache{
+		size:  size,
+		items: make(map[string]*list.Element, size),
+		order: list.New(),
+	}
+}
+
+// get: the cached node of name if it was looked up in the given version
+func (c *lookupCache) get(name string, version uint64) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[name]
+	if !ok {
+		return "", false
+	}
+	entry := e.Value.(*cacheEntry)
+	if entry.version != version {
+		c.order.Remove(e)
+		delete(c.items, name)
+		return "", false
+	}
+	c.order.MoveToFront(e)
+	return entry.node, true
+}
+
+// add: cache the node of name looked up in version, evicting the least
+// recently used name when the cache is full
+func (c *lookupCache) add(name, node string, version uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[name]; ok {
+		e.Value = &cacheEntry{name: name, node: node, version: version}
+		c.order.MoveToFront(e)
+		return
+	}
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).name)
+	}
+	c.items[name] = c.order.PushFront(&cacheEntry{name: name, node: node, version: version})
+}
+
+// len: number of cached names
+func (c *lookupCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
@@ -0,0 +1,64 @@
+package consistentHash
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHashRing_LookupCache(t *testing.T) {
+	r := NewHashRing(WithLookupCache(10))
+	plain := NewHashRing()
+	for i := 1; i <= 5; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i), 1)
+		plain.AddNode("192.168.1."+strconv.Itoa(i), 1)
+	}
+
+	// hits return what a lookup without cache returns
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 20; i++ {
+			key := "key" + strconv.Itoa(i)
+			node, _ := r.GetNode(key)
+			expected, _ := plain.GetNode(key)
+			if node != expected {
+				t.Error(key, "got", node, ", expected", expected)
+			}
+		}
+	}
+	checkEqual(r.cache.len(), 10, t)
+	if _, ok := r.cache.get("key19", r.loadSnapshot().version); !ok {
+		t.Error("expected key19 in the cache")
+	}
+	if _, ok := r.cache.get("key0", r.loadSnapshot().version); ok {
+		t.Error("expected key0 to be evicted")
+	}
+}
+
+func TestHashRing_LookupCacheRemoveNode(t *testing.T) {
+	r := NewHashRing(WithLookupCache(100))
+	for i := 1; i <= 5; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i), 1)
+	}
+	keys := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		keys[key], _ = r.GetNode(key)
+	}
+
+	r.RemoveNode("192.168.1.1")
+	for key, before := range keys {
+		node, _ := r.GetNode(key)
+		if node == "192.168.1.1" {
+			t.Fatal(key, "got the removed node")
+		}
+		if before != "192.168.1.1" && node != before {
+			t.Error(key, "moved from", before, "to", node)
+		}
+	}
+
+	r.AddNode("192.168.1.1", 1)
+	for key, before := range keys {
+		if node, _ := r.GetNode(key); node != before {
+			t.Error(key, "got", node, ", expected", before)
+		}
+	}
+}
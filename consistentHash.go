@@ -1,18 +1,50 @@
 package consistentHash
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/crc32"
+	"maps"
+	"math"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 var (
+	// GHashRing is the optional package-wide ring managed by InitHashRing
+	// and GetHashRing, rings created by NewHashRing are independent of it
 	GHashRing           *HashRing
 	DefaultVirtualCubes = 128
 )
 
+// DefaultStickyWindow is the number of cubes GetNodeSticky looks ahead
+// unless the ring is created with WithStickyWindow
+const DefaultStickyWindow = 8
+
+var (
+	// ErrEmptyRing is returned by lookups on a ring without nodes
+	ErrEmptyRing = errors.New("empty hash ring")
+	// ErrNodeNotFound is returned, possibly wrapped, for unknown nodes
+	ErrNodeNotFound = errors.New("node does not exist in the ring")
+	// ErrNoNodeAvailable is returned by lookups when every node is excluded
+	ErrNoNodeAvailable = errors.New("no node available")
+	// ErrNotEnoughNodes is returned, wrapped, by GetNodesStrict when the
+	// ring has fewer nodes than asked for
+	ErrNotEnoughNodes = errors.New("not enough nodes in the ring")
+	// ErrNotInitialized is returned by changes of a nil ring or of a ring
+	// not created by NewHashRing
+	ErrNotInitialized = errors.New("hash ring not initialized, create it by NewHashRing")
+)
+
+// testHookUpdateSortedRing is called on each sortedRing rebuild by tests
+var testHookUpdateSortedRing func()
+
 // Implement sort interface
 type uintArray []uint32
 
@@ -20,48 +52,192 @@ func (x uintArray) Len() int           { return len(x) }
 func (x uintArray) Less(i, j int) bool { return x[i] < x[j] }
 func (x uintArray) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
 
+// HashFunc maps a virtual key or lookup name to a position on the ring
+type HashFunc func(data []byte) uint32
+
+// KeyFunc formats the key of the index-th virtual cube of node ip
+type KeyFunc func(ip string, index int) string
+
 // HashRing struct
 // ring:          map, key is hash of cubes, value is real node
 // sortedRing:    slice, sorted array which elements is the ring's key
+// collisions:    map, key is hash of cubes, value is the nodes whose cube lost it
 // members:       map, key is real nodes, value is true or false
 // weights:       map, key is real nodes, value is this node's weight
+// cubes:         map, key is real nodes, value is this node's cubes per weight
+// meta:          map, key is real nodes, value is this node's metadata
 // numberOfCubes: number of virtual cubes per node
+// hashFunc:      hash function of the ring, nil means CRC32-IEEE
+// keyFunc:       key format of the cubes, nil means "ip#index"
+// ketama:        cubes take their hashes 4 by 4 from MD5 digests, see NewKetamaRing
+// seed:          salt of every hash of the ring, 0 means none
+// keyBits:       width of the hashes of the ring, 0 means 32
+// maxWeight:     larger weights are rejected, 0 means no cap
+// weightScale:   factor turning float weights into weights, 0 means none yet
+// expectedNodes: size hint of the maps of a new ring, see WithExpectedNodes
+// cache:         LRU cache of GetNode, nil means none, see WithLookupCache
+// logger:        called on changes and failed lookups, nil means no log
+// stickyWindow:  cubes GetNodeSticky looks ahead, 0 means DefaultStickyWindow
+// disabled:      cubes hidden from lookups, see RingTesting.DisablePoint
+// snapshot:      read state of the ring used by lookups without locking
+// inclusive:     a hash equal to a cube belongs to that cube, not the next one
+// onAdd:         callbacks fired after nodes are added
+// onRemove:      callbacks fired after nodes are removed
 type HashRing struct {
 	ring          map[uint32]string
 	sortedRing    uintArray
+	collisions    map[uint32][]string
 	members       map[string]bool
 	weights       map[string]int
+	cubes         map[string]int
+	meta          map[string]map[string]string
 	numberOfCubes int
+	hashFunc      HashFunc
+	keyFunc       KeyFunc
+	ketama        bool
+	seed          uint32
+	keyBits       int
+	maxWeight     int
+	weightScale   int
+	expectedNodes int
+	cache         *lookupCache
+	logger        func(format string, args ...any)
+	stickyWindow  int
+	disabled      map[uint32]bool
+	inclusive     bool
+	snapshot      atomic.Pointer[ringSnapshot]
+	onAdd         []func(ip string)
+	onRemove      []func(ip string)
 	sync.RWMutex
 }
 
-func InitHashRing() *HashRing {
-	GHashRing = &HashRing{
+// NewHashRing creates a standalone hash ring configured by opts
+func NewHashRing(opts ...Option) *HashRing {
+	r := &HashRing{
 		ring:          make(map[uint32]string),
 		members:       make(map[string]bool),
 		weights:       make(map[string]int),
+		cubes:         make(map[string]int),
+		meta:          make(map[string]map[string]string),
 		numberOfCubes: DefaultVirtualCubes,
 	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.presize()
+	r.publish()
+	return r
+}
+
+// presize: allocate the maps of a ring without nodes for expectedNodes
+// nodes, once the options have set the cube number
+func (r *HashRing) presize() {
+	if r.expectedNodes <= 0 || len(r.members) != 0 {
+		return
+	}
+	n := r.expectedNodes
+	r.ring = make(map[uint32]string, n*r.numberOfCubes)
+	r.members = make(map[string]bool, n)
+	r.weights = make(map[string]int, n)
+	r.cubes = make(map[string]int, n)
+}
+
+// InitHashRing creates a ring with default options and stores it in GHashRing
+func InitHashRing() *HashRing {
+	GHashRing = NewHashRing()
 	return GHashRing
 }
 
+// GetHashRing returns GHashRing, creating it by InitHashRing if needed
 func GetHashRing() *HashRing {
 	if GHashRing != nil {
 		return GHashRing
 	}
-	GHashRing = &HashRing{
-		ring:          make(map[uint32]string),
-		members:       make(map[string]bool),
-		weights:       make(map[string]int),
-		numberOfCubes: DefaultVirtualCubes,
+	return InitHashRing()
+}
+
+// Clone returns an independent deep copy of the ring, nil for a nil ring
+// and an uninitialized ring for an uninitialized one
+func (r *HashRing) Clone() *HashRing {
+	if r == nil {
+		return nil
 	}
-	return GHashRing
+	r.RLock()
+	defer r.RUnlock()
+
+	if r.ring == nil {
+		return &HashRing{}
+	}
+	c := &HashRing{
+		ring:          make(map[uint32]string, len(r.ring)),
+		sortedRing:    make(uintArray, len(r.sortedRing)),
+		members:       make(map[string]bool, len(r.members)),
+		weights:       make(map[string]int, len(r.weights)),
+		cubes:         make(map[string]int, len(r.cubes)),
+		meta:          make(map[string]map[string]string, len(r.meta)),
+		numberOfCubes: r.numberOfCubes,
+		hashFunc:      r.hashFunc,
+		keyFunc:       r.keyFunc,
+		ketama:        r.ketama,
+		seed:          r.seed,
+		keyBits:       r.keyBits,
+		maxWeight:     r.maxWeight,
+		weightScale:   r.weightScale,
+		logger:        r.logger,
+		stickyWindow:  r.stickyWindow,
+		inclusive:     r.inclusive,
+	}
+	if r.cache != nil {
+		c.cache = newLookupCache(r.cache.size)
+	}
+	for k, v := range r.ring {
+		c.ring[k] = v
+	}
+	for k, v := range r.collisions {
+		if c.collisions == nil {
+			c.collisions = make(map[uint32][]string, len(r.collisions))
+		}
+		c.collisions[k] = append([]string(nil), v...)
+	}
+	for k, v := range r.disabled {
+		if c.disabled == nil {
+			c.disabled = make(map[uint32]bool, len(r.disabled))
+		}
+		c.disabled[k] = v
+	}
+	copy(c.sortedRing, r.sortedRing)
+	for k, v := range r.members {
+		c.members[k] = v
+	}
+	for k, v := range r.weights {
+		c.weights[k] = v
+	}
+	for k, v := range r.cubes {
+		c.cubes[k] = v
+	}
+	for k, v := range r.meta {
+		c.meta[k] = copyMeta(v)
+	}
+	c.publish()
+	return c
+}
+
+// SetCubeNumber sets the number of virtual cubes per node of GHashRing,
+// creating it if needed
+func SetCubeNumber(num int) error {
+	return GetHashRing().SetCubeNumber(num)
 }
 
 // Set the number of virtual cubes per node
 // Notice: SetCubeNumber must be called before AddNode or AddNodes
 func (r *HashRing) SetCubeNumber(num int) (err error) {
-	if len(GHashRing.members) != 0 {
+	if r == nil {
+		return ErrNotInitialized
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.members) != 0 {
 		err = errors.New("nodes already exist in the ring, modify cube number is not allowed")
 		return
 	}
@@ -74,8 +250,94 @@ func (r *HashRing) SetCubeNumber(num int) (err error) {
 	return
 }
 
+// Set the maximum weight of a node in unscaled units, 0 means no cap
+// Nodes already in the ring are not checked against the new cap
+func (r *HashRing) SetMaxWeight(max int) error {
+	if r == nil {
+		return ErrNotInitialized
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	if max < 0 {
+		return errors.New("max weight must not be negative")
+	}
+	r.maxWeight = max
+	return nil
+}
+
+// Set the hash function of the ring, nil restores the default CRC32-IEEE
+// Notice: SetHashFunc must be called before AddNode or AddNodes
+func (r *HashRing) SetHashFunc(fn HashFunc) error {
+	if r == nil {
+		return ErrNotInitialized
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.members) != 0 {
+		return errors.New("nodes already exist in the ring, modify hash function is not allowed")
+	}
+	r.hashFunc = fn
+	r.publish()
+	return nil
+}
+
+// OnAdd registers fn to be called with the ip of each node added by AddNode,
+// AddNodeWithCubes, AddNodeStats or AddNodes. Callbacks run synchronously
+// in registration order once the change is complete, without holding the
+// lock, so they may use the ring.
+func (r *HashRing) OnAdd(fn func(ip string)) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	r.onAdd = append(r.onAdd, fn)
+}
+
+// OnRemove registers fn to be called with the ip of each node removed by
+// RemoveNode, RemoveNodeStats or RemoveNodes, the same way as OnAdd.
+func (r *HashRing) OnRemove(fn func(ip string)) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	r.onRemove = append(r.onRemove, fn)
+}
+
+// log: pass an event to the logger of the ring, if any
+func (r *HashRing) log(format string, args ...any) {
+	if r != nil && r.logger != nil {
+		r.logger(format, args...)
+	}
+}
+
+// logEmpty: log a lookup of name on an empty ring, without allocating
+// when there is no logger
+func (r *HashRing) logEmpty(name string) {
+	if r != nil && r.logger != nil {
+		r.logger("lookup of %q on an empty ring", name)
+	}
+}
+
+// notify: call each callback with each ip
+func notify(callbacks []func(ip string), ips ...string) {
+	for _, ip := range ips {
+		for _, fn := range callbacks {
+			fn(ip)
+		}
+	}
+}
+
 // Get the real nodes in the consistent hash ring
 func (r *HashRing) Members() []string {
+	if r == nil {
+		return nil
+	}
 	r.RLock()
 	defer r.RUnlock()
 
@@ -86,153 +348,1529 @@ func (r *HashRing) Members() []string {
 	return m
 }
 
-// Generate key based on node ip and cube index
-func (r *HashRing) generateKey(ip string, i int) string {
+// SortedMembers returns the real nodes in lexicographic order
+func (r *HashRing) SortedMembers() []string {
+	m := r.Members()
+	sort.Strings(m)
+	return m
+}
+
+// HasNode reports whether ip is a real node of the ring
+func (r *HashRing) HasNode(ip string) bool {
+	if r == nil {
+		return false
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.members[ip]
+}
+
+// NodeCount returns the number of real nodes in the ring
+func (r *HashRing) NodeCount() int {
+	if r == nil {
+		return 0
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	return len(r.members)
+}
+
+// VirtualCubes returns the number of virtual cubes per weight of new nodes
+func (r *HashRing) VirtualCubes() int {
+	if r == nil {
+		return 0
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.numberOfCubes
+}
+
+// Weight returns the weight of ip in the units of AddNode and whether it is
+// a node of the ring, fractional weights of AddNodeFloat are rounded down
+func (r *HashRing) Weight(ip string) (int, bool) {
+	if r == nil {
+		return 0, false
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	weight, ok := r.weights[ip]
+	return weight / r.scale(), ok
+}
+
+// Weights returns a copy of the weight of every node like Weight
+func (r *HashRing) Weights() map[string]int {
+	if r == nil {
+		return map[string]int{}
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	w := make(map[string]int, len(r.weights))
+	for k, v := range r.weights {
+		w[k] = v / r.scale()
+	}
+	return w
+}
+
+// Generate key based on node ip and cube index. The index has digits only,
+// so the last "#" separates it from ip and two different (ip, i) pairs
+// never share a key, even when ip contains "#".
+func generateKey(ip string, i int) string {
 	return ip + "#" + strconv.Itoa(i)
 }
 
+// cubeKey: key of the i-th cube of ip with keyFunc, or generateKey by default
+func (r *HashRing) cubeKey(ip string, i int) string {
+	if r.keyFunc != nil {
+		return r.keyFunc(ip, i)
+	}
+	return generateKey(ip, i)
+}
+
 // Generate hash value based on the above key
+
 func (r *HashRing) generateHash(key string) uint32 {
-	return crc32.ChecksumIEEE([]byte(key))
+	return r.hashBytes([]byte(key))
+}
+
+// hashBytes: hash data with hashFunc, or CRC32-IEEE by default
+func (r *HashRing) hashBytes(data []byte) uint32 {
+	return hashWith(r.hashFunc, r.seed, r.keyBits, data)
+}
+
+// finishHash: salt and mask hash as configured for the ring
+func (r *HashRing) finishHash(hash uint32) uint32 {
+	return finishHash(hash, r.seed, r.keyBits)
+}
+
+// hashWith: hash data with fn, or CRC32-IEEE if fn is nil, then finish it
+func hashWith(fn HashFunc, seed uint32, keyBits int, data []byte) uint32 {
+	if fn != nil {
+		return finishHash(fn(data), seed, keyBits)
+	}
+	return finishHash(crc32.ChecksumIEEE(data), seed, keyBits)
+}
+
+// finishHash: mix hash with seed, then keep its low keyBits bits. Cubes and
+// names go through the same bijection, so a seed reorders the whole ring,
+// 0 keeps hash. A keyBits of 0 keeps all 32 bits.
+func finishHash(hash, seed uint32, keyBits int) uint32 {
+	if seed != 0 {
+		hash = fmix32(hash ^ seed)
+	}
+	if keyBits > 0 && keyBits < 32 {
+		hash &= 1<<keyBits - 1
+	}
+	return hash
 }
 
 // AddNode: add a node in the consistent hash ring.
-func (r *HashRing) AddNode(ip string, weight int) {
+func (r *HashRing) AddNode(ip string, weight int) error {
+	if r == nil {
+		return ErrNotInitialized
+	}
 	r.Lock()
-	defer r.Unlock()
+	if err := r.checkNode(ip, weight); err != nil {
+		r.Unlock()
+		return err
+	}
+	isNew := r.addNode(ip, r.scaledWeight(weight), r.nodeCubes(ip))
+	onAdd := r.onAdd
+	r.Unlock()
 
-	if weight <= 0 {
-		weight = 1
+	if isNew {
+		notify(onAdd, ip)
 	}
-	for i := 0; i < r.numberOfCubes*weight; i++ {
-		r.ring[r.generateHash(r.generateKey(ip, i))] = ip
+	return nil
+}
+
+// AddNodeWithCubes: add a node with its own number of cubes per weight
+// instead of the ring's cube number, a non-positive cubes uses the latter
+func (r *HashRing) AddNodeWithCubes(ip string, weight int, cubes int) error {
+	if r == nil {
+		return ErrNotInitialized
 	}
-	r.members[ip] = true
-	r.weights[ip] = weight
+	r.Lock()
+	if err := r.checkNode(ip, weight); err != nil {
+		r.Unlock()
+		return err
+	}
+	if cubes <= 0 {
+		cubes = r.numberOfCubes
+	}
+	weight = r.scaledWeight(weight)
+	if err := checkCubes(ip, cubes, weight); err != nil {
+		r.Unlock()
+		return err
+	}
+	isNew := r.addNode(ip, weight, cubes)
+	onAdd := r.onAdd
+	r.Unlock()
 
-	r.updateSortedRing()
+	if isNew {
+		notify(onAdd, ip)
+	}
+	return nil
 }
 
-// AddNodes: add multiple nodes at once
-// Param: map, key is real node ip, value is this node's weight
-func (r *HashRing) AddNodes(ipWeight map[string]int) {
+// AddNodeMeta: add a node like AddNode and attach a copy of meta to it,
+// e.g. its rack or zone, replacing any previous metadata of the node.
+// A change of the metadata alone publishes a new Version.
+func (r *HashRing) AddNodeMeta(ip string, weight int, meta map[string]string) error {
+	if r == nil {
+		return ErrNotInitialized
+	}
 	r.Lock()
-	defer r.Unlock()
+	if err := r.checkNode(ip, weight); err != nil {
+		r.Unlock()
+		return err
+	}
+	if r.meta == nil {
+		r.meta = make(map[string]map[string]string)
+	}
+	changed := !maps.Equal(r.meta[ip], meta)
+	r.meta[ip] = copyMeta(meta)
+	version := r.loadSnapshot().version
+	isNew := r.addNode(ip, r.scaledWeight(weight), r.nodeCubes(ip))
+	if changed && r.loadSnapshot().version == version {
+		r.publish()
+	}
+	onAdd := r.onAdd
+	r.Unlock()
 
-	for ip, weight := range ipWeight {
-		if weight <= 0 {
-			weight = 1
+	if isNew {
+		notify(onAdd, ip)
+	}
+	return nil
+}
+
+// maxWeightScale is the largest factor AddNodeFloat scales weights by,
+// float weights are rounded to its precision
+const maxWeightScale = 1000
+
+// AddNodeFloat: add a node with a fractional weight, e.g. 1.5 for a node
+// taking 1.5 times the keys of a node of weight 1. The weight cap applies
+// to float weights, e.g. a cap of 3 accepts 1.5 or 3. Float weights become
+// weights by the weight scale of the ring, the smallest power of 10 up to
+// 1000 turning all of them into integers, finer weights are rounded.
+// Notice: a weight needing a larger scale multiplies the weight of every
+// node of the ring by the ratio of the scales to preserve their ratios.
+// Every node gets cubes added, the ring grows by that ratio and keys move
+// between all the nodes, so give the finest weight first. An int weight of
+// AddNode, UpdateWeight or AddNodes keeps meaning that many times a node of
+// weight 1 whatever the scale, see WeightScale.
+func (r *HashRing) AddNodeFloat(ip string, weight float64) error {
+	if r == nil {
+		return ErrNotInitialized
+	}
+	if !(weight > 0) || math.IsInf(weight, 1) {
+		return fmt.Errorf("weight %v of node %s must be a positive number", weight, ip)
+	}
+	r.Lock()
+	scale := r.scale()
+	factor := 1
+	if needed := floatScale(weight); needed > scale {
+		factor, scale = needed/scale, needed
+	}
+	scaled := math.Round(weight * float64(scale))
+	if scaled >= math.MaxInt {
+		r.Unlock()
+		return fmt.Errorf("weight %v of node %s overflows int", weight, ip)
+	}
+	if err := r.checkScaledNode(ip, int(scaled), scale); err != nil {
+		r.Unlock()
+		return err
+	}
+	if factor > 1 {
+		for node, w := range r.weights {
+			if r.cubes[node]*w > math.MaxInt/factor {
+				r.Unlock()
+				return fmt.Errorf("rescaling weight %d of node %s by %d overflows int", w, node, factor)
+			}
 		}
-		for i := 0; i < r.numberOfCubes*weight; i++ {
-			r.ring[r.generateHash(r.generateKey(ip, i))] = ip
+		var inserted []uint32
+		for node, w := range r.weights {
+			if node == ip {
+				// resized by addNode
+				continue
+			}
+			added, _ := r.resizeCubes(node, w, w*factor)
+			inserted = append(inserted, added...)
+			r.weights[node] = w * factor
 		}
-		r.members[ip] = true
-		r.weights[ip] = weight
+		r.insertSorted(inserted)
 	}
+	r.weightScale = scale
+	isNew := r.addNode(ip, int(scaled), r.nodeCubes(ip))
+	onAdd := r.onAdd
+	r.Unlock()
 
-	r.updateSortedRing()
+	if isNew {
+		notify(onAdd, ip)
+	}
+	return nil
 }
 
-// RemoveNode: removes a node from the consistent hash ring.
-func (r *HashRing) RemoveNode(elt string) {
-	r.Lock()
-	defer r.Unlock()
-
-	weight := r.weights[elt]
-	for i := 0; i < r.numberOfCubes*weight; i++ {
-		delete(r.ring, r.generateHash(r.generateKey(elt, i)))
+// floatScale: the smallest power of 10 up to maxWeightScale turning weight
+// into an integer, maxWeightScale if there is none
+func floatScale(weight float64) int {
+	scale := 1
+	for ; scale < maxWeightScale; scale *= 10 {
+		scaled := weight * float64(scale)
+		if math.Abs(scaled-math.Round(scaled)) < 1e-9*scaled {
+			break
+		}
 	}
-	delete(r.members, elt)
-	delete(r.weights, elt)
-	r.updateSortedRing()
+	return scale
 }
 
-// GetNode returns a node close to where name hashes to in the ring.
-func (r *HashRing) GetNode(name string) (node string, err error) {
+// WeightScale returns the factor between weights and the units the cubes
+// of the nodes are counted in, 1 until a fractional weight is added and
+// again once the ring has no node
+func (r *HashRing) WeightScale() int {
+	if r == nil {
+		return 1
+	}
 	r.RLock()
 	defer r.RUnlock()
 
-	if len(r.ring) == 0 {
-		return "", errors.New("empty hash ring")
-	}
-	key := r.generateHash(name)
-	index := r.search(key)
-	node = r.ring[r.sortedRing[index]]
-	err = nil
-	return
+	return r.scale()
 }
 
-// GetN returns the N closest distinct real nodes to the name input in the ring.
-func (r *HashRing) GetNodes(name string, n int) (nodes []string, err error) {
+// scale: see WeightScale, the caller holds the lock
+func (r *HashRing) scale() int {
+	return max(r.weightScale, 1)
+}
+
+// Meta returns a copy of the metadata of ip, nil if it has none
+func (r *HashRing) Meta(ip string) map[string]string {
+	if r == nil {
+		return nil
+	}
 	r.RLock()
 	defer r.RUnlock()
 
-	err = nil
-	if len(r.ring) == 0 {
-		nodes = nil
-		return
+	return copyMeta(r.meta[ip])
+}
+
+// copyMeta: copy of a metadata map, nil stays nil
+func copyMeta(meta map[string]string) map[string]string {
+	if meta == nil {
+		return nil
+	}
+	c := make(map[string]string, len(meta))
+	for k, v := range meta {
+		c[k] = v
 	}
+	return c
+}
 
-	memberCount := len(r.Members())
-	if int64(memberCount) < int64(n) {
-		n = int(memberCount)
+// AddNodeStats: add a node and report the share of keyspace it takes over
+func (r *HashRing) AddNodeStats(ip string, weight int) (RemapStats, error) {
+	if r == nil {
+		return RemapStats{}, ErrNotInitialized
+	}
+	r.Lock()
+	if err := r.checkNode(ip, weight); err != nil {
+		r.Unlock()
+		return RemapStats{}, err
 	}
+	old := r.loadSnapshot()
+	isNew := r.addNode(ip, r.scaledWeight(weight), r.nodeCubes(ip))
+	stats := remapStats(old, r.loadSnapshot())
+	onAdd := r.onAdd
+	r.Unlock()
 
-	// get the first node
-	key := r.generateHash(name)
-	i := r.search(key)
-	elem := r.ring[r.sortedRing[i]]
-	nodes = append(nodes, elem)
-	if len(nodes) == n {
-		return
+	if isNew {
+		notify(onAdd, ip)
 	}
+	return stats, nil
+}
+
+// nodeCubes: cubes per weight of ip if it is a node of the ring, so that
+// adding it again keeps the number of AddNodeWithCubes, else the cube
+// number of the ring. The caller holds the lock.
+func (r *HashRing) nodeCubes(ip string) int {
+	if cubes, ok := r.cubes[ip]; ok {
+		return cubes
+	}
+	return r.numberOfCubes
+}
+
+// addNode: place a node and merge its cubes into sortedRing, an existing
+// node has its cubes resized to match the new weight and cube number.
+// Adding a node again with the same weight and cubes, e.g. on a retry,
+// changes nothing and publishes no new version.
+// The caller holds the lock. Return: whether ip was not a member before
+func (r *HashRing) addNode(ip string, weight int, cubes int) bool {
+	weight = r.normalizeWeight(weight)
+	oldWeight, exists := r.weights[ip]
+	if exists && r.cubes[ip] == cubes && oldWeight == weight {
+		return false
+	}
+	if exists && r.cubes[ip] == cubes {
+		added, removed := r.resizeCubes(ip, oldWeight, weight)
+		r.insertSorted(added)
+		r.removeSorted(removed)
+		r.weights[ip] = weight
+		r.publish()
+		return false
+	}
+	if exists {
+		r.removeSorted(r.removeCubes(ip, 0, r.cubes[ip]*oldWeight))
+	}
+	added := r.addCubes(ip, 0, cubes*weight)
+	r.members[ip] = true
+	r.weights[ip] = weight
+	r.cubes[ip] = cubes
+	r.insertSorted(added)
+	r.publish()
+	if !exists {
+		r.log("node %s added with weight %d", ip, weight)
+	}
+	return !exists
+}
 
-	// get the rest of the nodes
-	start := i
-	for i = start + 1; i != start; i++ {
-		if i >= len(r.sortedRing) {
-			i = 0
+// AddNodes: add multiple nodes at once, no node is added if one is invalid.
+// Nodes already in the ring get their cubes resized to the new weight.
+// Param: map, key is real node ip, value is this node's weight
+// Return: sorted new nodes, and sorted existing nodes whose weight changed
+func (r *HashRing) AddNodes(ipWeight map[string]int) (added, updated []string, err error) {
+	if r == nil {
+		return nil, nil, ErrNotInitialized
+	}
+	r.Lock()
+	for ip, weight := range ipWeight {
+		if err = r.checkNode(ip, weight); err != nil {
+			r.Unlock()
+			return nil, nil, err
 		}
-		elem = r.ring[r.sortedRing[i]]
-		if !sliceHasMember(nodes, elem) {
-			nodes = append(nodes, elem)
+	}
+	added, updated = r.addNodes(ipWeight)
+	if len(added) > 0 || len(updated) > 0 {
+		r.updateSortedRing()
+		r.publish()
+	}
+	onAdd := r.onAdd
+	r.Unlock()
+
+	notify(onAdd, added...)
+	return added, updated, nil
+}
+
+// AddNodesStaged is AddNodes for large batches: the cubes of the new nodes
+// are hashed and sorted before taking the write lock, which is only held to
+// merge them into the ring and publish it. Lookups see either the old or
+// the new ring. The ring must not be reconfigured, e.g. by SetHashFunc,
+// while the batch is staged.
+func (r *HashRing) AddNodesStaged(ipWeight map[string]int) (added, updated []string, err error) {
+	if r == nil {
+		return nil, nil, ErrNotInitialized
+	}
+	r.RLock()
+	for ip, weight := range ipWeight {
+		if err = r.checkNode(ip, weight); err != nil {
+			r.RUnlock()
+			return nil, nil, err
 		}
-		if len(nodes) == n {
-			break
+	}
+	stage := &HashRing{
+		hashFunc: r.hashFunc,
+		keyFunc:  r.keyFunc,
+		ketama:   r.ketama,
+		seed:     r.seed,
+		keyBits:  r.keyBits,
+	}
+	cubes := r.numberOfCubes
+	scale := r.scale()
+	staged := make(map[string]bool)
+	for ip := range ipWeight {
+		if _, ok := r.weights[ip]; !ok {
+			staged[ip] = true
 		}
 	}
+	r.RUnlock()
 
-	return
-}
+	var points []stagedPoint
+	for ip := range staged {
+		weight := ipWeight[ip]
+		for _, hash := range stage.cubeHashes(ip, 0, cubes*r.normalizeWeight(weight)*scale) {
+			points = append(points, stagedPoint{hash: hash, ip: ip})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
 
-// search: find the cube of key's hash value clockwise
-func (r *HashRing) search(key uint32) (index int) {
-	compareFunc := func(x int) bool {
-		return r.sortedRing[x] > key
+	r.Lock()
+	if r.scale() != scale {
+		// rescaled by AddNodeFloat since staging
+		staged, points = nil, nil
+	}
+	var inserted, removed []uint32
+	for _, ip := range sortedIPs(ipWeight) {
+		weight := r.scaledWeight(ipWeight[ip])
+		if oldWeight, ok := r.weights[ip]; ok {
+			if weight != oldWeight {
+				more, less := r.resizeCubes(ip, oldWeight, weight)
+				inserted = append(inserted, more...)
+				removed = append(removed, less...)
+				r.weights[ip] = weight
+				updated = append(updated, ip)
+			}
+			continue
+		}
+		added = append(added, ip)
+	}
+	isAdded := make(map[string]bool, len(added))
+	for _, ip := range added {
+		isAdded[ip] = true
+		if !staged[ip] {
+			// removed by another writer since staging
+			inserted = append(inserted, r.addCubes(ip, 0, cubes*r.scaledWeight(ipWeight[ip]))...)
+		}
+		r.members[ip] = true
+		r.weights[ip] = r.scaledWeight(ipWeight[ip])
+		r.cubes[ip] = cubes
+		r.log("node %s added with weight %d", ip, r.weights[ip])
+	}
+	for _, p := range points {
+		// nodes added by another writer since staging were resized above
+		if !isAdded[p.ip] {
+			continue
+		}
+		if r.claim(p.hash, p.ip) {
+			inserted = append(inserted, p.hash)
+		}
+	}
+	if len(added) > 0 || len(updated) > 0 {
+		r.removeSorted(removed)
+		r.insertSorted(inserted)
+		r.publish()
 	}
-	index = sort.Search(len(r.sortedRing), compareFunc)
-	if index >= len(r.sortedRing) {
-		index = 0
+	onAdd := r.onAdd
+	r.Unlock()
+
+	notify(onAdd, added...)
+	return added, updated, nil
+}
+
+// stagedPoint: a cube hashed by AddNodesStaged before it is placed
+type stagedPoint struct {
+	hash uint32
+	ip   string
+}
+
+// addNodes: place new nodes and resize existing ones without rebuilding
+// sortedRing, the caller holds the lock and has checked the weights.
+// Nodes are placed in ID order, so the result does not depend on the
+// iteration order of the map.
+func (r *HashRing) addNodes(ipWeight map[string]int) (added, updated []string) {
+	for _, ip := range sortedIPs(ipWeight) {
+		weight := r.scaledWeight(ipWeight[ip])
+		if oldWeight, ok := r.weights[ip]; ok {
+			if weight != oldWeight {
+				r.resizeCubes(ip, oldWeight, weight)
+				r.weights[ip] = weight
+				updated = append(updated, ip)
+			}
+			continue
+		}
+		r.addCubes(ip, 0, r.numberOfCubes*weight)
+		r.members[ip] = true
+		r.weights[ip] = weight
+		r.cubes[ip] = r.numberOfCubes
+		r.log("node %s added with weight %d", ip, weight)
+		added = append(added, ip)
 	}
 	return
 }
 
-// updateSortedRing: when hash ring is change, update sortedRing
-func (r *HashRing) updateSortedRing() {
-	hashes := uintArray{}
-	for k := range r.ring {
-		hashes = append(hashes, k)
+// sortedIPs: the node IDs of ipWeight in ascending order
+func sortedIPs(ipWeight map[string]int) []string {
+	ips := make([]string, 0, len(ipWeight))
+	for ip := range ipWeight {
+		ips = append(ips, ip)
 	}
-	sort.Sort(hashes)
-	r.sortedRing = hashes
+	sort.Strings(ips)
+	return ips
 }
 
-// sliceHasMember: judge whether the member is include in the slice
-func sliceHasMember(slice []string, member string) bool {
-	for _, m := range slice {
-		if m == member {
-			return true
+// ReplaceAllNodes: make ipWeight the node set of the ring in one step.
+// Nodes not in ipWeight are removed, the others are added or have their
+// weight changed, so only the keys of changed nodes move. Readers see
+// either the old or the new node set. No node changes if one is invalid.
+func (r *HashRing) ReplaceAllNodes(ipWeight map[string]int) error {
+	if r == nil {
+		return ErrNotInitialized
+	}
+	r.Lock()
+	if r.ring == nil {
+		r.Unlock()
+		return ErrNotInitialized
+	}
+	for ip, weight := range ipWeight {
+		if err := r.checkNode(ip, weight); err != nil {
+			r.Unlock()
+			return err
 		}
 	}
-	return false
+	var removed []string
+	for ip, weight := range r.weights {
+		if _, ok := ipWeight[ip]; !ok {
+			r.removeCubes(ip, 0, r.cubes[ip]*weight)
+			removed = append(removed, ip)
+		}
+	}
+	sort.Strings(removed)
+	for _, ip := range removed {
+		r.forget(ip)
+	}
+	added, updated := r.addNodes(ipWeight)
+	if len(removed) > 0 || len(added) > 0 || len(updated) > 0 {
+		r.resetScale()
+		r.updateSortedRing()
+		r.publish()
+	}
+	onAdd, onRemove := r.onAdd, r.onRemove
+	r.Unlock()
+
+	notify(onRemove, removed...)
+	notify(onAdd, added...)
+	return nil
+}
+
+// RemoveNode: removes a node from the consistent hash ring.
+// Return false, leaving the ring untouched, if elt is not a node of the ring.
+func (r *HashRing) RemoveNode(elt string) bool {
+	if r == nil {
+		return false
+	}
+	r.Lock()
+	removed := r.removeNode(elt)
+	onRemove := r.onRemove
+	r.Unlock()
+
+	if removed {
+		notify(onRemove, elt)
+	}
+	return removed
+}
+
+// RemoveNodeStats: remove a node and report the share of keyspace handed
+// over to the remaining nodes
+func (r *HashRing) RemoveNodeStats(elt string) RemapStats {
+	if r == nil {
+		return RemapStats{}
+	}
+	r.Lock()
+	old := r.loadSnapshot()
+	removed := r.removeNode(elt)
+	stats := remapStats(old, r.loadSnapshot())
+	onRemove := r.onRemove
+	r.Unlock()
+
+	if removed {
+		notify(onRemove, elt)
+	}
+	return stats
+}
+
+// removeNode: delete a node and drop its cubes from sortedRing,
+// report whether the node was in the ring, the caller holds the lock
+func (r *HashRing) removeNode(elt string) bool {
+	if _, ok := r.members[elt]; !ok {
+		return false
+	}
+	removed := r.removeCubes(elt, 0, r.cubes[elt]*r.weights[elt])
+	r.forget(elt)
+	r.resetScale()
+	r.removeSorted(removed)
+	r.publish()
+	return true
+}
+
+// RemoveNodes: remove multiple nodes at once, unknown nodes are skipped
+func (r *HashRing) RemoveNodes(ips []string) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	var removed []string
+	for _, ip := range ips {
+		weight, ok := r.weights[ip]
+		if !ok {
+			continue
+		}
+		r.removeCubes(ip, 0, r.cubes[ip]*weight)
+		r.forget(ip)
+		removed = append(removed, ip)
+	}
+	if len(removed) > 0 {
+		r.resetScale()
+		r.updateSortedRing()
+		r.publish()
+	}
+	onRemove := r.onRemove
+	r.Unlock()
+
+	notify(onRemove, removed...)
+}
+
+// RemoveByPrefix: remove every node whose id starts with prefix, e.g. the
+// pods of a StatefulSet, return the number of nodes removed. An empty
+// prefix removes every node, firing the OnRemove callbacks unlike Clear.
+func (r *HashRing) RemoveByPrefix(prefix string) int {
+	if r == nil {
+		return 0
+	}
+	r.Lock()
+	var removed []string
+	for ip, weight := range r.weights {
+		if !strings.HasPrefix(ip, prefix) {
+			continue
+		}
+		r.removeCubes(ip, 0, r.cubes[ip]*weight)
+		removed = append(removed, ip)
+	}
+	sort.Strings(removed)
+	for _, ip := range removed {
+		r.forget(ip)
+	}
+	if len(removed) > 0 {
+		r.resetScale()
+		r.updateSortedRing()
+		r.publish()
+	}
+	onRemove := r.onRemove
+	r.Unlock()
+
+	notify(onRemove, removed...)
+	return len(removed)
+}
+
+// Clear: remove every node, the configuration of the ring is kept and the
+// weight scale reset. OnRemove callbacks are not fired. An uninitialized
+// ring stays so.
+func (r *HashRing) Clear() {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	if r.ring == nil {
+		return
+	}
+	r.log("ring cleared, %d nodes removed", len(r.members))
+	r.ring = make(map[uint32]string)
+	r.disabled = nil
+	r.collisions = nil
+	r.sortedRing = nil
+	r.members = make(map[string]bool)
+	r.weights = make(map[string]int)
+	r.cubes = make(map[string]int)
+	r.meta = make(map[string]map[string]string)
+	r.weightScale = 0
+	r.publish()
+}
+
+// forget: delete the state of a node whose cubes are already removed,
+// the caller holds the lock
+func (r *HashRing) forget(ip string) {
+	r.log("node %s removed", ip)
+	delete(r.members, ip)
+	delete(r.weights, ip)
+	delete(r.cubes, ip)
+	delete(r.meta, ip)
+}
+
+// resetScale: drop the weight scale once the ring has no node left,
+// the caller holds the lock
+func (r *HashRing) resetScale() {
+	if len(r.weights) == 0 {
+		r.weightScale = 0
+	}
+}
+
+// UpdateWeight: change the weight of an existing node in place.
+// Only the difference in virtual cubes is added or removed.
+func (r *HashRing) UpdateWeight(ip string, newWeight int) error {
+	if r == nil {
+		return ErrNotInitialized
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	if r.ring == nil {
+		return ErrNotInitialized
+	}
+	weight, ok := r.weights[ip]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNodeNotFound, ip)
+	}
+	if err := r.checkScale(ip, newWeight); err != nil {
+		return err
+	}
+	newWeight = r.scaledWeight(newWeight)
+	if err := r.checkWeight(ip, newWeight, r.scale()); err != nil {
+		return err
+	}
+	if err := checkCubes(ip, r.cubes[ip], newWeight); err != nil {
+		return err
+	}
+	if newWeight == weight {
+		return nil
+	}
+	added, removed := r.resizeCubes(ip, weight, newWeight)
+	r.insertSorted(added)
+	r.removeSorted(removed)
+	r.weights[ip] = newWeight
+	r.publish()
+	return nil
+}
+
+// DrainNode returns a function lowering the weight of ip by a steps-th of
+// its weight at the time of DrainNode per call, the last call removes it. Each call
+// only moves the keys of the cubes it removes. The function reports
+// whether the node is drained, and an error if ip is not in the ring.
+// When the weight is below steps, some calls leave the weight unchanged.
+func (r *HashRing) DrainNode(ip string, steps int) func() (done bool, err error) {
+	if r == nil {
+		return func() (bool, error) { return false, ErrNotInitialized }
+	}
+	if steps <= 0 {
+		steps = 1
+	}
+	r.RLock()
+	weight := r.weights[ip]
+	r.RUnlock()
+
+	step := 0
+	return func() (bool, error) {
+		r.Lock()
+		current, ok := r.weights[ip]
+		if !ok || step >= steps {
+			r.Unlock()
+			return false, fmt.Errorf("%w: %s", ErrNodeNotFound, ip)
+		}
+		step++
+		if step == steps {
+			r.removeNode(ip)
+			onRemove := r.onRemove
+			r.Unlock()
+
+			notify(onRemove, ip)
+			return true, nil
+		}
+		if target := weight * (steps - step) / steps; target > 0 && target < current {
+			_, removed := r.resizeCubes(ip, current, target)
+			r.removeSorted(removed)
+			r.weights[ip] = target
+			r.publish()
+		}
+		r.Unlock()
+		return false, nil
+	}
+}
+
+// resizeCubes: add or remove the cubes of a node for its weight to go from
+// weight to newWeight, return the hashes added to and removed from the ring
+func (r *HashRing) resizeCubes(ip string, weight, newWeight int) (added, removed []uint32) {
+	cubes := r.cubes[ip]
+	if newWeight > weight {
+		return r.addCubes(ip, cubes*weight, cubes*newWeight), nil
+	}
+	return nil, r.removeCubes(ip, cubes*newWeight, cubes*weight)
+}
+
+// normalizeWeight: non-positive weights default to 1
+func (r *HashRing) normalizeWeight(weight int) int {
+	if weight <= 0 {
+		weight = 1
+	}
+	return weight
+}
+
+// checkNode: reject uninitialized rings, empty node ids, ids with
+// surrounding whitespace and weights above maxWeight, weight is in the
+// unscaled units of AddNode
+func (r *HashRing) checkNode(ip string, weight int) error {
+	if err := r.checkScale(ip, weight); err != nil {
+		return err
+	}
+	return r.checkScaledNode(ip, r.scaledWeight(weight), r.scale())
+}
+
+// checkScale: reject weights of AddNode which overflow int once scaled
+func (r *HashRing) checkScale(ip string, weight int) error {
+	if scale := r.scale(); weight > math.MaxInt/scale {
+		return fmt.Errorf("weight %d of node %s overflows int at weight scale %d", weight, ip, scale)
+	}
+	return nil
+}
+
+// scaledWeight: weight of AddNode in units of the weight scale,
+// non-positive weights count as 1, the caller holds the lock
+func (r *HashRing) scaledWeight(weight int) int {
+	return r.normalizeWeight(weight) * r.scale()
+}
+
+// checkScaledNode: see checkNode, weight is in units of the weight scale
+func (r *HashRing) checkScaledNode(ip string, weight, scale int) error {
+	if r.ring == nil {
+		return ErrNotInitialized
+	}
+	if ip == "" {
+		return errors.New("node id must not be empty")
+	}
+	if strings.TrimSpace(ip) != ip {
+		return fmt.Errorf("node id %q must not begin or end with whitespace", ip)
+	}
+	if err := r.checkWeight(ip, weight, scale); err != nil {
+		return err
+	}
+	cubes := r.numberOfCubes
+	if c := r.cubes[ip]; c > cubes {
+		cubes = c
+	}
+	return checkCubes(ip, cubes, weight)
+}
+
+// checkCubes: reject a number of cubes times weight which overflows int,
+// it would leave the node without cubes
+func checkCubes(ip string, cubes, weight int) error {
+	if weight > 0 && cubes > math.MaxInt/weight {
+		return fmt.Errorf("%d cubes per weight at weight %d of node %s overflow int", cubes, weight, ip)
+	}
+	return nil
+}
+
+// checkWeight: reject weights above maxWeight, weight is in units of the
+// weight scale and maxWeight in unscaled units
+func (r *HashRing) checkWeight(ip string, weight, scale int) error {
+	if r.maxWeight > 0 && r.maxWeight <= math.MaxInt/scale && weight > r.maxWeight*scale {
+		return fmt.Errorf("weight %d of node %s exceeds the cap %d at weight scale %d", weight, ip, r.maxWeight, scale)
+	}
+	return nil
+}
+
+// addCubes: place the virtual cubes [from, to) of a node in the ring,
+// return the hashes which were not in the ring yet
+func (r *HashRing) addCubes(ip string, from, to int) (added []uint32) {
+	for _, hash := range r.cubeHashes(ip, from, to) {
+		if r.claim(hash, ip) {
+			added = append(added, hash)
+		}
+	}
+	return
+}
+
+// claim: place a cube of ip at hash, report whether hash is new to the
+// ring. When cubes collide the smallest node id owns the hash, whatever
+// the order they were added in, and the other claims are kept in collisions.
+func (r *HashRing) claim(hash uint32, ip string) bool {
+	owner, ok := r.ring[hash]
+	if !ok {
+		r.ring[hash] = ip
+		return true
+	}
+	if r.collisions == nil {
+		r.collisions = make(map[uint32][]string)
+	}
+	r.log("cube %#08x of node %s collides with node %s", hash, ip, owner)
+	if ip < owner {
+		r.ring[hash] = ip
+		ip = owner
+	}
+	r.collisions[hash] = append(r.collisions[hash], ip)
+	return false
+}
+
+// release: drop a cube of ip at hash, report whether hash left the ring.
+// If the owner leaves, the smallest remaining claim takes the hash over.
+func (r *HashRing) release(hash uint32, ip string) bool {
+	owner, ok := r.ring[hash]
+	if !ok {
+		return false
+	}
+	claims := r.collisions[hash]
+	for i, c := range claims {
+		if c == ip {
+			r.dropClaim(hash, i)
+			return false
+		}
+	}
+	if owner != ip {
+		return false
+	}
+	if len(claims) == 0 {
+		delete(r.ring, hash)
+		return true
+	}
+	next := 0
+	for i, c := range claims {
+		if c < claims[next] {
+			next = i
+		}
+	}
+	r.ring[hash] = claims[next]
+	r.dropClaim(hash, next)
+	return false
+}
+
+// dropClaim: remove the i-th losing claim of hash
+func (r *HashRing) dropClaim(hash uint32, i int) {
+	claims := r.collisions[hash]
+	if len(claims) == 1 {
+		delete(r.collisions, hash)
+		return
+	}
+	claims[i] = claims[len(claims)-1]
+	r.collisions[hash] = claims[:len(claims)-1]
+}
+
+// cubeHashes: hashes of the virtual cubes [from, to) of a node. A ketama
+// ring takes 4 consecutive cubes from the digest of one key.
+func (r *HashRing) cubeHashes(ip string, from, to int) []uint32 {
+	hashes := make([]uint32, 0, to-from)
+	var points [4]uint32
+	for i := from; i < to; i++ {
+		if !r.ketama {
+			hashes = append(hashes, r.generateHash(r.cubeKey(ip, i)))
+			continue
+		}
+		if i == from || i%4 == 0 {
+			points = ketamaPoints(r.cubeKey(ip, i/4))
+		}
+		hashes = append(hashes, r.finishHash(points[i%4]))
+	}
+	return hashes
+}
+
+// removeCubes: delete the virtual cubes [from, to) of a node from the ring,
+// return the hashes which left the ring
+func (r *HashRing) removeCubes(ip string, from, to int) (removed []uint32) {
+	for _, hash := range r.cubeHashes(ip, from, to) {
+		if r.release(hash, ip) {
+			removed = append(removed, hash)
+		}
+	}
+	return
+}
+
+// GetNode returns a node close to where name hashes to in the ring.
+// With WithLookupCache, names looked up since the last change of the ring
+// are answered from the cache.
+func (r *HashRing) GetNode(name string) (node string, err error) {
+	s := r.loadSnapshot()
+	if len(s.sortedRing) == 0 {
+		r.logEmpty(name)
+		return "", ErrEmptyRing
+	}
+	if r.cache == nil {
+		return s.nodes[s.search(s.hash(name))], nil
+	}
+	if node, ok := r.cache.get(name, s.version); ok {
+		return node, nil
+	}
+	node = s.nodes[s.search(s.hash(name))]
+	r.cache.add(name, node, s.version)
+	return node, nil
+}
+
+// GetNodeBatch returns the node of each name, nodes[i] is the node of
+// names[i]. Every name is resolved against the same state of the ring.
+func (r *HashRing) GetNodeBatch(names []string) (nodes []string, err error) {
+	s := r.loadSnapshot()
+	if len(s.sortedRing) == 0 {
+		return nil, ErrEmptyRing
+	}
+	nodes = make([]string, len(names))
+	for i, name := range names {
+		nodes[i] = s.nodes[s.search(s.hash(name))]
+	}
+	return nodes, nil
+}
+
+// GetNodeParallel is GetNodeBatch splitting names between workers goroutines,
+// a non-positive workers uses GOMAXPROCS. Every node is "" on an empty ring.
+func (r *HashRing) GetNodeParallel(names []string, workers int) []string {
+	s := r.loadSnapshot()
+	nodes := make([]string, len(names))
+	if len(s.sortedRing) == 0 {
+		return nodes
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	size := (len(names) + workers - 1) / workers
+
+	var wg sync.WaitGroup
+	for start := 0; start < len(names); start += size {
+		end := start + size
+		if end > len(names) {
+			end = len(names)
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				nodes[i] = s.nodes[s.search(s.hash(names[i]))]
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	return nodes
+}
+
+// GetNodeBytes is GetNode for a name held in a byte slice, it hashes name
+// in place and does not allocate
+func (r *HashRing) GetNodeBytes(name []byte) (string, error) {
+	s := r.loadSnapshot()
+	if len(s.sortedRing) == 0 {
+		if r != nil && r.logger != nil {
+			r.logEmpty(string(name))
+		}
+		return "", ErrEmptyRing
+	}
+	return s.nodes[s.search(s.hashBytes(name))], nil
+}
+
+// GetNodeNS returns the node of name within namespace, e.g. a tenant, so
+// that the same name in two namespaces is placed independently. The key
+// hashed is the length of namespace, namespace and name: unlike a plain
+// concatenation, ("a", "bc") and ("ab", "c") are different keys.
+func (r *HashRing) GetNodeNS(namespace, name string) (string, error) {
+	return r.GetNodeBytes(namespacedKey(namespace, name))
+}
+
+// namespacedKey: the uvarint length of namespace, namespace, then name
+func namespacedKey(namespace, name string) []byte {
+	key := make([]byte, 0, binary.MaxVarintLen64+len(namespace)+len(name))
+	key = binary.AppendUvarint(key, uint64(len(namespace)))
+	key = append(key, namespace...)
+	return append(key, name...)
+}
+
+// GetNodeSticky returns lastNode if it owns one of the cubes of the sticky
+// window of the ring, see WithStickyWindow, clockwise from where name hashes
+// to, starting at the owner of name, so that a key keeps its node across
+// small changes of the ring. Otherwise it returns the owner of name like
+// GetNode.
+func (r *HashRing) GetNodeSticky(name string, lastNode string) (string, error) {
+	s := r.loadSnapshot()
+	if len(s.sortedRing) == 0 {
+		return "", ErrEmptyRing
+	}
+	index := s.search(s.hash(name))
+	window := r.stickyWindow
+	if window <= 0 {
+		window = DefaultStickyWindow
+	}
+	if window > len(s.sortedRing) {
+		window = len(s.sortedRing)
+	}
+	for i := 0; i < window && lastNode != ""; i++ {
+		if s.nodes[(index+i)%len(s.sortedRing)] == lastNode {
+			return lastNode, nil
+		}
+	}
+	return s.nodes[index], nil
+}
+
+// GetNodeMeta is GetNode also returning a copy of the metadata of the node
+func (r *HashRing) GetNodeMeta(name string) (ip string, meta map[string]string, err error) {
+	if r == nil {
+		return "", nil, ErrEmptyRing
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	s := r.loadSnapshot()
+	if len(s.sortedRing) == 0 {
+		return "", nil, ErrEmptyRing
+	}
+	ip = s.nodes[s.search(s.hash(name))]
+	return ip, copyMeta(r.meta[ip]), nil
+}
+
+// GetNodesAcrossZones returns up to n nodes for name in n distinct zones,
+// the zone of a node is its metadata value for zoneKey and nodes without
+// it share the zone "". It walks clockwise like GetNodes, skipping the
+// nodes in a zone already chosen. If there are fewer than n zones, the
+// nodes found are returned with an error.
+func (r *HashRing) GetNodesAcrossZones(name string, n int, zoneKey string) ([]string, error) {
+	if r == nil {
+		return nil, ErrEmptyRing
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	s := r.loadSnapshot()
+	if len(s.sortedRing) == 0 {
+		return nil, ErrEmptyRing
+	}
+	zones := make(map[string]bool)
+	nodes := s.distinctNodesFrom(s.search(s.hash(name)), n, func(node string) bool {
+		zone := r.meta[node][zoneKey]
+		if zones[zone] {
+			return true
+		}
+		zones[zone] = true
+		return false
+	})
+	if len(nodes) < n {
+		return nodes, fmt.Errorf("found %d of %d zones", len(nodes), n)
+	}
+	return nodes, nil
+}
+
+// GetNodeDetail is GetNode also returning the hash of the cube name landed on
+func (r *HashRing) GetNodeDetail(name string) (node string, point uint32, err error) {
+	s := r.loadSnapshot()
+	if len(s.sortedRing) == 0 {
+		return "", 0, ErrEmptyRing
+	}
+	index := s.search(s.hash(name))
+	return s.nodes[index], s.sortedRing[index], nil
+}
+
+// GetNodeCtx is GetNode returning ctx.Err() if ctx is already done
+func (r *HashRing) GetNodeCtx(ctx context.Context, name string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return r.GetNode(name)
+}
+
+// Hash returns the position of name on the ring, as used by GetNode
+func (r *HashRing) Hash(name string) uint32 {
+	return r.loadSnapshot().hash(name)
+}
+
+// GetNodeForHash returns the node close to a precomputed hash value,
+// GetNode(name) is GetNodeForHash of the ring's hash of name.
+func (r *HashRing) GetNodeForHash(hash uint32) (string, error) {
+	s := r.loadSnapshot()
+	if len(s.sortedRing) == 0 {
+		return "", ErrEmptyRing
+	}
+	return s.nodes[s.search(hash)], nil
+}
+
+// GetN returns the N closest distinct real nodes to the name input in the ring.
+// N is capped to the number of real nodes, an empty ring is an error like in GetNode.
+// Nodes come in the order their first cube is met clockwise from where name
+// hashes to, the first one is GetNode(name). A node with more weight has
+// more cubes, so it is more likely to come early, see GetNodesUniformOrder.
+func (r *HashRing) GetNodes(name string, n int) (nodes []string, err error) {
+	s := r.loadSnapshot()
+	if len(s.sortedRing) == 0 {
+		r.logEmpty(name)
+		return nil, ErrEmptyRing
+	}
+	return s.getNodes(s.hash(name), n), nil
+}
+
+// GetNodesInto is GetNodes storing the nodes in dst, truncated first, so
+// that callers can reuse a buffer, e.g. from a sync.Pool. It returns dst,
+// grown if its capacity is below n.
+func (r *HashRing) GetNodesInto(name string, n int, dst []string) ([]string, error) {
+	s := r.loadSnapshot()
+	if len(s.sortedRing) == 0 {
+		return dst[:0], ErrEmptyRing
+	}
+	return s.distinctNodesInto(dst[:0], s.search(s.hash(name)), n, 0, nil), nil
+}
+
+// GetNodesStrict is GetNodes failing with ErrNotEnoughNodes, along with
+// the nodes found, when the ring has fewer than n nodes instead of capping n
+func (r *HashRing) GetNodesStrict(name string, n int) ([]string, error) {
+	nodes, err := r.GetNodes(name, n)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) < n {
+		return nodes, fmt.Errorf("%w: %d of %d", ErrNotEnoughNodes, len(nodes), n)
+	}
+	return nodes, nil
+}
+
+// GetNodesUniformOrder returns up to n distinct nodes for name in an order
+// which does not depend on weights: nodes are ranked by their unweighted
+// rendezvous score for name, so every node is equally likely to come first
+// and removing a node does not reorder the others. It scores every node,
+// so it costs O(nodes) per call.
+func (r *HashRing) GetNodesUniformOrder(name string, n int) ([]string, error) {
+	if r == nil {
+		return nil, ErrEmptyRing
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	if len(r.members) == 0 {
+		return nil, ErrEmptyRing
+	}
+	nodes := make([]string, 0, len(r.members))
+	scores := make(map[string]float64, len(r.members))
+	for ip := range r.members {
+		nodes = append(nodes, ip)
+		scores[ip] = rendezvousScore(name, ip, 1)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if scores[nodes[i]] != scores[nodes[j]] {
+			return scores[nodes[i]] > scores[nodes[j]]
+		}
+		return nodes[i] < nodes[j]
+	})
+	if n < 0 {
+		n = 0
+	}
+	if n < len(nodes) {
+		nodes = nodes[:n]
+	}
+	return nodes, nil
+}
+
+// GetNodesLimited is GetNodes visiting at most maxProbe cubes of the ring,
+// which bounds the lookup time on skewed rings. It returns the distinct
+// nodes found so far and whether they are as many as GetNodes would return.
+// A non-positive maxProbe means no limit.
+func (r *HashRing) GetNodesLimited(name string, n int, maxProbe int) (nodes []string, full bool, err error) {
+	s := r.loadSnapshot()
+	if len(s.sortedRing) == 0 {
+		return nil, false, ErrEmptyRing
+	}
+	nodes = s.getNodesLimited(s.hash(name), n, maxProbe)
+	if n > s.members {
+		n = s.members
+	}
+	return nodes, len(nodes) >= n, nil
+}
+
+// NodeDistance is a node found for a key and the clockwise gap from the
+// key's hash to the cube that selected it
+type NodeDistance struct {
+	Node     string
+	Distance uint32
+}
+
+// GetNodesWithDistance is GetNodes also returning how far clockwise each
+// node's cube lies from the hash of name. Distances do not decrease, a
+// smaller distance means a more natural owner of the key.
+func (r *HashRing) GetNodesWithDistance(name string, n int) ([]NodeDistance, error) {
+	s := r.loadSnapshot()
+	if len(s.sortedRing) == 0 {
+		return nil, ErrEmptyRing
+	}
+	if n > s.members {
+		n = s.members
+	}
+	if n < 0 {
+		n = 0
+	}
+	hash := s.hash(name)
+	w := s.walker(s.search(hash))
+	nodes := make([]NodeDistance, 0, n)
+	for len(nodes) < n {
+		node, ok := w.next()
+		if !ok {
+			break
+		}
+		// the walker has moved past the cube of node
+		index := (w.i + len(s.sortedRing) - 1) % len(s.sortedRing)
+		distance := (uint64(s.sortedRing[index]) - uint64(hash) + s.space) % s.space
+		nodes = append(nodes, NodeDistance{Node: node, Distance: uint32(distance)})
+	}
+	return nodes, nil
+}
+
+// GetReplicas returns the primary node of name followed by up to replicas
+// distinct backup nodes clockwise.
+func (r *HashRing) GetReplicas(name string, replicas int) ([]string, error) {
+	s := r.loadSnapshot()
+	if len(s.sortedRing) == 0 {
+		return nil, ErrEmptyRing
+	}
+	if replicas < 0 {
+		replicas = 0
+	}
+	return s.getNodes(s.hash(name), replicas+1), nil
+}
+
+// Walk returns an iterator over the distinct real nodes clockwise from
+// where name hashes to. Each call yields the next node, the iterator
+// reports false once every node has been yielded. It walks the ring as
+// it was when Walk is called.
+func (r *HashRing) Walk(name string) func() (string, bool) {
+	s := r.loadSnapshot()
+	if len(s.sortedRing) == 0 {
+		return func() (string, bool) { return "", false }
+	}
+	return s.walker(s.search(s.hash(name))).next
+}
+
+// GetNodeExcluding returns the first node clockwise from where name hashes
+// to which is not in exclude, so callers can fail over without changing the ring.
+func (r *HashRing) GetNodeExcluding(name string, exclude map[string]bool) (string, error) {
+	s := r.loadSnapshot()
+	if len(s.sortedRing) == 0 {
+		return "", ErrEmptyRing
+	}
+	nodes := s.distinctNodesFrom(s.search(s.hash(name)), 1, func(node string) bool {
+		return exclude[node]
+	})
+	if len(nodes) == 0 {
+		return "", ErrNoNodeAvailable
+	}
+	return nodes[0], nil
+}
+
+// GetNodeWithFallback returns the first node clockwise from where name
+// hashes to which has not been tried yet. Callers mark the failed node in
+// tried and retry, until ErrNoNodeAvailable says every node was tried.
+func (r *HashRing) GetNodeWithFallback(name string, tried map[string]bool) (string, error) {
+	return r.GetNodeExcluding(name, tried)
+}
+
+// GetNodeBounded implements consistent hashing with bounded loads: starting
+// from the node close to name, nodes whose load exceeds capacity times the
+// average load are skipped clockwise. The caller maintains load, keyed by node.
+func (r *HashRing) GetNodeBounded(name string, load map[string]int64, capacity float64) (string, error) {
+	if r == nil {
+		return "", ErrEmptyRing
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	s := r.loadSnapshot()
+	if len(s.sortedRing) == 0 {
+		return "", ErrEmptyRing
+	}
+	var totalLoad int64
+	for node := range r.members {
+		totalLoad += load[node]
+	}
+	limit := capacity * float64(totalLoad) / float64(len(r.members))
+
+	nodes := s.distinctNodesFrom(s.search(s.hash(name)), 1, func(node string) bool {
+		return float64(load[node]) > limit
+	})
+	if len(nodes) == 0 {
+		return "", errors.New("all nodes are over capacity")
+	}
+	return nodes[0], nil
+}
+
+// GetWeightedNodes returns up to n distinct nodes for name, favoring heavy
+// nodes. It walks the distinct nodes clockwise like GetNodes and keeps each
+// node with probability weight / max weight, decided by a hash of name and
+// the node so that the result is stable. The heaviest nodes are always kept.
+// Nodes which were skipped fill up the result in walk order if the walk
+// ends before n nodes are kept.
+func (r *HashRing) GetWeightedNodes(name string, n int) ([]string, error) {
+	if r == nil {
+		return nil, ErrEmptyRing
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	s := r.loadSnapshot()
+	if len(s.sortedRing) == 0 {
+		return nil, ErrEmptyRing
+	}
+	maxWeight := 0
+	for _, weight := range r.weights {
+		if weight > maxWeight {
+			maxWeight = weight
+		}
+	}
+
+	var skipped []string
+	nodes := s.distinctNodesFrom(s.search(s.hash(name)), n, func(node string) bool {
+		u := float64(murmur3([]byte(name+"\x00"+node), 0)) / float64(keyspace)
+		if u*float64(maxWeight) < float64(r.weights[node]) {
+			return false
+		}
+		skipped = append(skipped, node)
+		return true
+	})
+	for _, node := range skipped {
+		if len(nodes) >= n {
+			break
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// updateSortedRing: when hash ring is change, update sortedRing
+func (r *HashRing) updateSortedRing() {
+	if testHookUpdateSortedRing != nil {
+		testHookUpdateSortedRing()
+	}
+	hashes := uintArray{}
+	for k := range r.ring {
+		hashes = append(hashes, k)
+	}
+	sort.Sort(hashes)
+	r.sortedRing = hashes
+}
+
+// insertSorted: merge new hashes into sortedRing without a full rebuild.
+// Costs O(N + K*log(K)) for K hashes instead of O(N*log(N)).
+// sortedRing is replaced rather than modified, so slices handed out
+// earlier stay valid.
+func (r *HashRing) insertSorted(hashes []uint32) {
+	if len(hashes) == 0 {
+		return
+	}
+	sort.Sort(uintArray(hashes))
+	merged := make(uintArray, 0, len(r.sortedRing)+len(hashes))
+	i, j := 0, 0
+	for i < len(r.sortedRing) && j < len(hashes) {
+		if r.sortedRing[i] < hashes[j] {
+			merged = append(merged, r.sortedRing[i])
+			i++
+		} else {
+			merged = append(merged, hashes[j])
+			j++
+		}
+	}
+	merged = append(merged, r.sortedRing[i:]...)
+	merged = append(merged, hashes[j:]...)
+	r.sortedRing = merged
+}
+
+// removeSorted: drop deleted hashes from sortedRing without a full rebuild,
+// sortedRing is replaced rather than modified
+func (r *HashRing) removeSorted(hashes []uint32) {
+	if len(hashes) == 0 {
+		return
+	}
+	sort.Sort(uintArray(hashes))
+	kept := make(uintArray, 0, len(r.sortedRing))
+	j := 0
+	for _, hash := range r.sortedRing {
+		for j < len(hashes) && hashes[j] < hash {
+			j++
+		}
+		if j < len(hashes) && hashes[j] == hash {
+			continue
+		}
+		kept = append(kept, hash)
+	}
+	r.sortedRing = kept
+}
+
+// ringNodes: owners of the cubes of sortedRing, the i-th node owns sortedRing[i]
+func (r *HashRing) ringNodes(sortedRing uintArray) []string {
+	nodes := make([]string, len(sortedRing))
+	for i, hash := range sortedRing {
+		nodes[i] = r.ring[hash]
+	}
+	return nodes
 }
@@ -1,10 +1,19 @@
 package consistentHash
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func checkEqual(num, expected int, t *testing.T) {
@@ -30,6 +39,58 @@ func TestHashRing_AddNode(t *testing.T) {
 	}
 }
 
+func TestHashRing_AddNodeInvalidID(t *testing.T) {
+	r := NewHashRing()
+	for _, ip := range []string{"", " ", "192.168.1.1 ", "\t192.168.1.1"} {
+		if err := r.AddNode(ip, 1); err == nil {
+			t.Errorf("AddNode(%q) expected an error", ip)
+		}
+		if err := r.AddNodeWithCubes(ip, 1, 4); err == nil {
+			t.Errorf("AddNodeWithCubes(%q) expected an error", ip)
+		}
+		if _, _, err := r.AddNodes(map[string]int{"192.168.1.2": 1, ip: 1}); err == nil {
+			t.Errorf("AddNodes(%q) expected an error", ip)
+		}
+		if err := r.ReplaceAllNodes(map[string]int{ip: 1}); err == nil {
+			t.Errorf("ReplaceAllNodes(%q) expected an error", ip)
+		}
+	}
+	checkEqual(r.NodeCount(), 0, t)
+	checkEqual(len(r.ring), 0, t)
+
+	if err := r.AddNode("192.168.1.1", 1); err != nil {
+		t.Error("valid node got", err)
+	}
+	if _, _, err := r.AddNodes(map[string]int{"node-2": 1, "shard#3": 1}); err != nil {
+		t.Error("valid nodes got", err)
+	}
+	checkEqual(r.NodeCount(), 3, t)
+}
+
+func TestHashRing_AddNodeOverflow(t *testing.T) {
+	huge := math.MaxInt/DefaultVirtualCubes + 1
+	r := NewHashRing()
+	if err := r.AddNode("192.168.1.1", huge); err == nil {
+		t.Error("expected an error for cubes times weight above MaxInt")
+	}
+	if _, _, err := r.AddNodes(map[string]int{"192.168.1.1": huge}); err == nil {
+		t.Error("AddNodes: expected an error for cubes times weight above MaxInt")
+	}
+	if err := r.AddNodeWithCubes("192.168.1.1", 2, math.MaxInt/2+1); err == nil {
+		t.Error("AddNodeWithCubes: expected an error for cubes times weight above MaxInt")
+	}
+	checkEqual(r.NodeCount(), 0, t)
+
+	r.AddNode("192.168.1.1", 1)
+	if err := r.UpdateWeight("192.168.1.1", huge); err == nil {
+		t.Error("UpdateWeight: expected an error for cubes times weight above MaxInt")
+	}
+	checkEqual(countCubes(r, "192.168.1.1"), DefaultVirtualCubes, t)
+	if err := checkCubes("192.168.1.1", DefaultVirtualCubes, huge-1); err != nil {
+		t.Error("largest weight got", err)
+	}
+}
+
 func TestSetCubeNumber(t *testing.T) {
 	r := InitHashRing()
 	r.SetCubeNumber(40)
@@ -39,6 +100,64 @@ func TestSetCubeNumber(t *testing.T) {
 	checkEqual(len(r.ring), 40, t)
 }
 
+func TestHashRing_VirtualCubes(t *testing.T) {
+	r := NewHashRing()
+	checkEqual(r.VirtualCubes(), DefaultVirtualCubes, t)
+	r.SetCubeNumber(40)
+	checkEqual(r.VirtualCubes(), 40, t)
+	checkEqual(NewHashRing(WithVirtualCubes(16)).VirtualCubes(), 16, t)
+	checkEqual(NewKetamaRing().VirtualCubes(), KetamaPoints, t)
+}
+
+func TestSetCubeNumber_LocalRing(t *testing.T) {
+	g := InitHashRing()
+	r := NewHashRing()
+	r.AddNode("192.168.1.10", 1)
+	if err := r.SetCubeNumber(40); err == nil {
+		t.Error("expected error when local ring already has nodes")
+	}
+	checkEqual(r.numberOfCubes, DefaultVirtualCubes, t)
+
+	g.AddNode("192.168.1.10", 1)
+	r = NewHashRing()
+	if err := r.SetCubeNumber(40); err != nil {
+		t.Error("nodes of the global ring must not affect a local ring:", err)
+	}
+	checkEqual(r.numberOfCubes, 40, t)
+}
+
+func TestSetCubeNumber_Global(t *testing.T) {
+	GHashRing = nil
+	if err := SetCubeNumber(40); err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(GetHashRing().numberOfCubes, 40, t)
+	GetHashRing().AddNode("192.168.1.10", 1)
+	if err := SetCubeNumber(50); err == nil {
+		t.Error("expected error when the global ring already has nodes")
+	}
+}
+
+func TestSetCubeNumber_Concurrent(t *testing.T) {
+	r := NewHashRing()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			r.SetCubeNumber(i%50 + 1)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		r.AddNode("192.168.1.10", 1)
+	}()
+	wg.Wait()
+
+	// whichever cube number won, it was not changed once the node was added
+	checkEqual(len(r.ring), r.numberOfCubes, t)
+}
+
 func TestHashRing_AddNodes(t *testing.T) {
 	r := InitHashRing()
 	Nodes := make(map[string]int)
@@ -54,128 +173,2130 @@ func TestHashRing_AddNodes(t *testing.T) {
 	}
 }
 
-func TestHashRing_RemoveNode(t *testing.T) {
+func TestHashRing_AddNodeFloat(t *testing.T) {
+	r := NewHashRing()
+	r.AddNode("192.168.1.1", 1)
+	checkEqual(r.WeightScale(), 1, t)
+
+	// 1.5 needs a scale of 10, which rescales the node added before
+	if err := r.AddNodeFloat("192.168.1.2", 1.5); err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(r.WeightScale(), 10, t)
+	checkEqual(r.weights["192.168.1.1"], 10, t)
+	checkEqual(r.weights["192.168.1.2"], 15, t)
+	// Weight reports the units of AddNode, rounded down
+	w1, _ := r.Weight("192.168.1.1")
+	w2, _ := r.Weight("192.168.1.2")
+	checkEqual(w1, 1, t)
+	checkEqual(w2, 1, t)
+	ratio := float64(countCubes(r, "192.168.1.2")) / float64(countCubes(r, "192.168.1.1"))
+	if math.Abs(ratio-1.5) > 0.01 {
+		t.Error("cube ratio is", ratio, ", expected 1.5")
+	}
+
+	// weights of the same scale leave the others alone
+	r.AddNodeFloat("192.168.1.3", 0.7)
+	checkEqual(r.WeightScale(), 10, t)
+	checkEqual(countCubes(r, "192.168.1.1"), 10*DefaultVirtualCubes, t)
+	if err := r.Verify(); err != nil {
+		t.Error(err)
+	}
+
+	// an int weight means the same whatever the scale
+	r.AddNode("192.168.1.5", 1)
+	checkEqual(countCubes(r, "192.168.1.5"), countCubes(r, "192.168.1.1"), t)
+	r.AddNodes(map[string]int{"192.168.1.6": 2})
+	checkEqual(countCubes(r, "192.168.1.6"), 20*DefaultVirtualCubes, t)
+	r.AddNodesStaged(map[string]int{"192.168.1.7": 1})
+	checkEqual(countCubes(r, "192.168.1.7"), 10*DefaultVirtualCubes, t)
+	r.UpdateWeight("192.168.1.5", 3)
+	checkEqual(countCubes(r, "192.168.1.5"), 30*DefaultVirtualCubes, t)
+	if w, _ := r.Weight("192.168.1.5"); w != 3 {
+		t.Error("weight got", w, ", expected 3")
+	}
+	checkEqual(r.Weights()["192.168.1.6"], 2, t)
+
+	for _, weight := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		if err := r.AddNodeFloat("192.168.1.4", weight); err == nil {
+			t.Error("expected an error for weight", weight)
+		}
+	}
+}
+
+func TestHashRing_AddNodeFloatCap(t *testing.T) {
+	// the cap is in unscaled units
+	r := NewHashRing(WithVirtualCubes(10), WithWeightCap(3))
+	if err := r.AddNode("192.168.1.1", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddNodeFloat("192.168.1.2", 1.5); err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(r.WeightScale(), 10, t)
+	checkEqual(r.weights["192.168.1.1"], 30, t)
+	if err := r.AddNodeFloat("192.168.1.3", 3); err != nil {
+		t.Error(err)
+	}
+	if err := r.AddNodeFloat("192.168.1.4", 3.1); err == nil {
+		t.Error("expected an error for a float weight above the cap")
+	}
+	if err := r.AddNodeFloat("192.168.1.4", 2.95); err != nil {
+		t.Error(err)
+	}
+	if err := r.AddNodeFloat("192.168.1.5", 3.05); err == nil {
+		t.Error("expected an error for a float weight above the cap")
+	}
+	if err := r.AddNode("192.168.1.5", 3); err != nil {
+		t.Error(err)
+	}
+	if err := r.UpdateWeight("192.168.1.5", 4); err == nil {
+		t.Error("expected an error updating weight above the cap")
+	}
+	checkEqual(r.NodeCount(), 5, t)
+}
+
+func TestHashRing_WeightScaleReset(t *testing.T) {
+	empty := map[string]func(r *HashRing){
+		"Clear":           func(r *HashRing) { r.Clear() },
+		"RemoveNode":      func(r *HashRing) { r.RemoveNode("192.168.1.1") },
+		"RemoveNodes":     func(r *HashRing) { r.RemoveNodes([]string{"192.168.1.1"}) },
+		"RemoveByPrefix":  func(r *HashRing) { r.RemoveByPrefix("192.168.") },
+		"ReplaceAllNodes": func(r *HashRing) { r.ReplaceAllNodes(nil) },
+	}
+	for name, fn := range empty {
+		r := NewHashRing()
+		r.AddNodeFloat("192.168.1.1", 1.5)
+		checkEqual(r.WeightScale(), 10, t)
+		fn(r)
+		if r.WeightScale() != 1 {
+			t.Error(name, "kept the weight scale", r.WeightScale(), "of an empty ring")
+		}
+		r.AddNode("192.168.1.2", 1)
+		r.AddNodeFloat("192.168.1.3", 2)
+		checkEqual(r.weights["192.168.1.3"], 2, t)
+	}
+
+	// the scale is kept while nodes are left
+	r := NewHashRing()
+	r.AddNodeFloat("192.168.1.1", 1.5)
+	r.AddNode("192.168.2.1", 10)
+	r.RemoveByPrefix("192.168.1.")
+	checkEqual(r.WeightScale(), 10, t)
+	r.ReplaceAllNodes(map[string]int{"192.168.3.1": 15})
+	checkEqual(r.WeightScale(), 10, t)
+}
+
+func TestHashRing_AddNodeMeta(t *testing.T) {
+	r := NewHashRing()
+	meta := map[string]string{"rack": "r1", "zone": "z1"}
+	if err := r.AddNodeMeta("192.168.1.1", 1, meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddNodeMeta("", 1, meta); err == nil {
+		t.Error("expected an error for an empty node id")
+	}
+	meta["zone"] = "changed"
+	if got := r.Meta("192.168.1.1"); got["rack"] != "r1" || got["zone"] != "z1" {
+		t.Error("got meta", got)
+	}
+	if r.Meta("192.168.1.2") != nil {
+		t.Error("unknown node got meta", r.Meta("192.168.1.2"))
+	}
+
+	ip, got, err := r.GetNodeMeta("key1")
+	if err != nil || ip != "192.168.1.1" || got["zone"] != "z1" {
+		t.Error("got", ip, got, err)
+	}
+	got["zone"] = "changed"
+	if r.Meta("192.168.1.1")["zone"] != "z1" {
+		t.Error("GetNodeMeta does not return a copy")
+	}
+
+	// new metadata alone publishes a new version, the same does not
+	version := r.Version()
+	r.AddNodeMeta("192.168.1.1", 1, map[string]string{"rack": "r1", "zone": "z2"})
+	if r.Version() <= version {
+		t.Error("version", r.Version(), "not bumped by new metadata")
+	}
+	if r.Meta("192.168.1.1")["zone"] != "z2" {
+		t.Error("got meta", r.Meta("192.168.1.1"))
+	}
+	version = r.Version()
+	r.AddNodeMeta("192.168.1.1", 1, map[string]string{"rack": "r1", "zone": "z2"})
+	checkEqual(int(r.Version()), int(version), t)
+	r.AddNodeMeta("192.168.1.1", 1, map[string]string{"rack": "r1", "zone": "z1"})
+
+	// AddNode keeps the metadata of an existing node
+	r.AddNode("192.168.1.1", 2)
+	if r.Meta("192.168.1.1")["zone"] != "z1" {
+		t.Error("metadata lost on reweight")
+	}
+
+	r.RemoveNode("192.168.1.1")
+	if r.Meta("192.168.1.1") != nil {
+		t.Error("metadata kept after removal")
+	}
+	checkEqual(len(r.meta), 0, t)
+	r.AddNodeMeta("192.168.1.2", 1, meta)
+	r.RemoveNodes([]string{"192.168.1.2"})
+	checkEqual(len(r.meta), 0, t)
+	if _, _, err := r.GetNodeMeta("key1"); err == nil {
+		t.Error("expected an error on an empty ring")
+	}
+}
+
+func TestHashRing_GetNodesAcrossZones(t *testing.T) {
+	r := NewHashRing()
+	r.AddNodeMeta("192.168.1.1", 1, map[string]string{"zone": "z1"})
+	r.AddNodeMeta("192.168.1.2", 1, map[string]string{"zone": "z1"})
+	r.AddNodeMeta("192.168.1.3", 1, map[string]string{"zone": "z2"})
+
+	for i := 0; i < 1000; i++ {
+		key := "key" + strconv.Itoa(i)
+		nodes, err := r.GetNodesAcrossZones(key, 2, "zone")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nodes) != 2 || r.Meta(nodes[0])["zone"] == r.Meta(nodes[1])["zone"] {
+			t.Fatal("key", key, "got", nodes)
+		}
+		if owner, _ := r.GetNode(key); nodes[0] != owner {
+			t.Fatal("key", key, "first node got", nodes[0], ", expected", owner)
+		}
+	}
+
+	nodes, err := r.GetNodesAcrossZones("key1", 3, "zone")
+	if err == nil || len(nodes) != 2 {
+		t.Error("3 of 2 zones got", nodes, err)
+	}
+	// nodes without the zone key share one zone
+	nodes, err = r.GetNodesAcrossZones("key1", 2, "rack")
+	if err == nil || len(nodes) != 1 {
+		t.Error("unknown zone key got", nodes, err)
+	}
+}
+
+func TestHashRing_AddNodeTwice(t *testing.T) {
 	r := InitHashRing()
-	r.AddNode("192.168.1.10", 1)
-	r.RemoveNode("192.168.1.10")
+	r.AddNode("192.168.1.1", 1)
+	r.AddNode("192.168.1.1", 2)
+	checkEqual(countCubes(r, "192.168.1.1"), DefaultVirtualCubes*2, t)
+	checkEqual(len(r.sortedRing), DefaultVirtualCubes*2, t)
+
+	r.AddNodeWithCubes("192.168.1.1", 2, 16)
+	checkEqual(countCubes(r, "192.168.1.1"), 32, t)
+	checkEqual(len(r.sortedRing), 32, t)
+
+	r.RemoveNode("192.168.1.1")
 	checkEqual(len(r.ring), 0, t)
 	checkEqual(len(r.sortedRing), 0, t)
-
-	Nodes := make(map[string]int)
-	for i := 0; i < 10; i++ {
-		ip := "192.168.1." + strconv.Itoa(i+1)
-		Nodes[ip] = i + 1
-	}
-	r.AddNodes(Nodes)
-	checkEqual(len(r.ring), 7040, t)
-	r.RemoveNode("192.168.1.10")
-	checkEqual(len(r.ring), 5760, t)
+	checkEqual(r.NodeCount(), 0, t)
 }
 
-func TestHashRing_Members(t *testing.T) {
+func TestHashRing_AddNodesUpdate(t *testing.T) {
 	r := InitHashRing()
-	Nodes := make(map[string]int)
-	for i := 0; i < 10; i++ {
-		ip := "192.168.1." + strconv.Itoa(i+1)
-		Nodes[ip] = i + 1
+	added, updated, err := r.AddNodes(map[string]int{"192.168.1.2": 1, "192.168.1.1": 1})
+	if err != nil {
+		t.Fatal(err)
 	}
-	r.AddNodes(Nodes)
-	checkEqual(len(r.Members()), 10, t)
+	if fmt.Sprint(added) != "[192.168.1.1 192.168.1.2]" || len(updated) != 0 {
+		t.Error("got added", added, "updated", updated)
+	}
+
+	added, updated, _ = r.AddNodes(map[string]int{"192.168.1.1": 3, "192.168.1.2": 1, "192.168.1.3": 1})
+	if fmt.Sprint(added) != "[192.168.1.3]" || fmt.Sprint(updated) != "[192.168.1.1]" {
+		t.Error("got added", added, "updated", updated)
+	}
+	checkEqual(countCubes(r, "192.168.1.1"), DefaultVirtualCubes*3, t)
+	checkEqual(len(r.ring), DefaultVirtualCubes*5, t)
+
+	added, updated, _ = r.AddNodes(map[string]int{"192.168.1.1": 1})
+	if len(added) != 0 || fmt.Sprint(updated) != "[192.168.1.1]" {
+		t.Error("got added", added, "updated", updated)
+	}
+	checkEqual(countCubes(r, "192.168.1.1"), DefaultVirtualCubes, t)
+
+	// no stale cube is left behind
+	r.RemoveNode("192.168.1.1")
+	checkEqual(countCubes(r, "192.168.1.1"), 0, t)
+	checkEqual(len(r.sortedRing), DefaultVirtualCubes*2, t)
 }
 
-func TestHashRing_GetNode(t *testing.T) {
-	testGet := []struct {
-		in, out string
-	}{
-		{"key1", "192.168.1.3"},
-		{"key2", "192.168.1.7"},
-		{"key3", "192.168.1.7"},
-		{"key4", "192.168.1.9"},
-		{"key5", "192.168.1.10"},
+func TestHashRing_AddNodeConcurrentSame(t *testing.T) {
+	r := NewHashRing()
+	var added sync.WaitGroup
+	var mu sync.Mutex
+	notified := 0
+	r.OnAdd(func(ip string) {
+		mu.Lock()
+		notified++
+		mu.Unlock()
+	})
+	version := r.Version()
+
+	for g := 0; g < 50; g++ {
+		added.Add(1)
+		go func() {
+			defer added.Done()
+			if err := r.AddNode("192.168.1.1", 1); err != nil {
+				t.Error(err)
+			}
+		}()
 	}
-	testGetAfterRemove := []struct {
-		in, out string
-	}{
-		{"key1", "192.168.1.3"},
-		{"key2", "192.168.1.7"},
-		{"key3", "192.168.1.7"},
-		{"key4", "192.168.1.9"},
-		{"key5", "192.168.1.3"},
+	added.Wait()
+
+	checkEqual(len(r.sortedRing), DefaultVirtualCubes, t)
+	checkEqual(r.IntendedVirtualNodeCount(), DefaultVirtualCubes, t)
+	checkEqual(notified, 1, t)
+	if r.Version() != version+1 {
+		t.Error("version went from", version, "to", r.Version(), ", expected one change")
 	}
+}
 
-	r := InitHashRing()
-	Nodes := make(map[string]int)
-	for i := 0; i < 10; i++ {
-		ip := "192.168.1." + strconv.Itoa(i+1)
-		Nodes[ip] = i + 1
+func TestHashRing_AddNodesOrderIndependent(t *testing.T) {
+	// 1280 cubes in 1000 positions, so collisions decide some owners
+	hashFunc := WithHashFunc(func(data []byte) uint32 {
+		return crc32.ChecksumIEEE(data) % 1000
+	})
+	ips := make([]string, 10)
+	for i := range ips {
+		ips[i] = "192.168.1." + strconv.Itoa(i+1)
+	}
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
 	}
-	r.AddNodes(Nodes)
 
-	for i, v := range testGet {
-		node, err := r.GetNode(v.in)
-		if err != nil {
-			t.Fatal(i, "err: ", err)
+	var expected *HashRing
+	for round := 0; round < 5; round++ {
+		var notified []string
+		r := NewHashRing(hashFunc)
+		r.OnAdd(func(ip string) { notified = append(notified, ip) })
+		batch := make(map[string]int)
+		for _, ip := range ips {
+			batch[ip] = 1
 		}
-		if node != v.out {
-			t.Error("index", i, "err: got", node, ", expected", v.out)
+		added, _, _ := r.AddNodes(batch)
+		if !sort.StringsAreSorted(added) || !sort.StringsAreSorted(notified) {
+			t.Error("round", round, "got added", added, "and notified", notified, "out of order")
+		}
+
+		// the same nodes one by one in a shuffled order
+		one := NewHashRing(hashFunc)
+		for i := range ips {
+			one.AddNode(ips[(i*7+round*3)%len(ips)], 1)
+		}
+
+		if expected == nil {
+			expected = r
+		}
+		for _, got := range []*HashRing{r, one} {
+			if fmt.Sprint(got.sortedRing) != fmt.Sprint(expected.sortedRing) {
+				t.Fatal("round", round, "built a different sortedRing")
+			}
+			for _, key := range keys {
+				node, _ := got.GetNode(key)
+				want, _ := expected.GetNode(key)
+				if node != want {
+					t.Fatal("round", round, "key", key, "got", node, ", expected", want)
+				}
+			}
 		}
 	}
+}
 
-	r.RemoveNode("192.168.1.10")
-	for i, v := range testGetAfterRemove {
-		node, err := r.GetNode(v.in)
+func TestHashRing_DrainNode(t *testing.T) {
+	r := NewHashRing()
+	r.AddNodes(map[string]int{"192.168.1.1": 8, "192.168.1.2": 1})
+	var removed []string
+	r.OnRemove(func(ip string) { removed = append(removed, ip) })
+
+	drain := r.DrainNode("192.168.1.1", 4)
+	last := countCubes(r, "192.168.1.1")
+	for step := 1; step <= 4; step++ {
+		before := make(map[string]string)
+		for i := 0; i < 1000; i++ {
+			key := "key" + strconv.Itoa(i)
+			before[key], _ = r.GetNode(key)
+		}
+		done, err := drain()
 		if err != nil {
-			t.Fatal(i, "err: ", err)
+			t.Fatal(err)
 		}
-		if node != v.out {
-			t.Error("index", i, "err: got", node, ", expected", v.out)
+		if done != (step == 4) {
+			t.Error("step", step, "done", done)
 		}
+		cubes := countCubes(r, "192.168.1.1")
+		if cubes >= last {
+			t.Error("step", step, "left", cubes, "cubes after", last)
+		}
+		last = cubes
+		// only keys of the drained node move
+		for key, node := range before {
+			if got, _ := r.GetNode(key); got != node && node != "192.168.1.1" {
+				t.Fatal("step", step, "moved", key, "from", node, "to", got)
+			}
+		}
+	}
+	checkEqual(last, 0, t)
+	checkEqual(r.NodeCount(), 1, t)
+	checkEqual(len(r.sortedRing), DefaultVirtualCubes, t)
+	if fmt.Sprint(removed) != "[192.168.1.1]" {
+		t.Error("removed", removed)
+	}
+	if _, err := drain(); err == nil {
+		t.Error("expected an error after the node is drained")
+	}
+	if _, err := r.DrainNode("192.168.1.3", 2)(); err == nil {
+		t.Error("expected an error for an unknown node")
 	}
 }
 
-func TestHashRing_GetNodes(t *testing.T) {
-	r := InitHashRing()
-	Nodes := make(map[string]int)
-	for i := 0; i < 10; i++ {
-		ip := "192.168.1." + strconv.Itoa(i+1)
-		Nodes[ip] = i + 1
+func TestHashRing_ReplaceAllNodes(t *testing.T) {
+	r := NewHashRing()
+	r.AddNodes(map[string]int{"192.168.1.1": 1, "192.168.1.2": 1, "192.168.1.3": 1})
+	var events []string
+	r.OnAdd(func(ip string) { events = append(events, "add "+ip) })
+	r.OnRemove(func(ip string) { events = append(events, "remove "+ip) })
+
+	before := make(map[string]string)
+	for i := 0; i < 10000; i++ {
+		key := "key" + strconv.Itoa(i)
+		before[key], _ = r.GetNode(key)
 	}
-	r.AddNodes(Nodes)
 
-	nodes, err := r.GetNodes("key1", 3)
-	if err != nil {
+	if err := r.ReplaceAllNodes(map[string]int{"192.168.1.2": 1, "192.168.1.3": 1, "192.168.1.4": 1}); err != nil {
 		t.Fatal(err)
 	}
-	if len(nodes) != 3 {
-		t.Error("expected 3 members instead of", len(nodes))
-	}
-	if nodes[0] != "192.168.1.3" {
-		t.Error("First node error, expected 192.168.1.3, but got", nodes[0])
+	if fmt.Sprint(r.SortedMembers()) != "[192.168.1.2 192.168.1.3 192.168.1.4]" {
+		t.Error("got members", r.SortedMembers())
 	}
-	if nodes[1] != "192.168.1.5" {
-		t.Error("Second node error, expected 192.168.1.5, but got", nodes[1])
+	if fmt.Sprint(events) != "[remove 192.168.1.1 add 192.168.1.4]" {
+		t.Error("got events", events)
 	}
-	if nodes[2] != "192.168.1.7" {
-		t.Error("Third node error, expected 192.168.1.7, but got", nodes[2])
+	checkEqual(len(r.sortedRing), 3*DefaultVirtualCubes, t)
+	checkEqual(countCubes(r, "192.168.1.1"), 0, t)
+
+	// keys of the common nodes only move to the new node
+	for key, node := range before {
+		if node == "192.168.1.1" {
+			continue
+		}
+		if got, _ := r.GetNode(key); got != node && got != "192.168.1.4" {
+			t.Fatal("key", key, "moved from", node, "to", got)
+		}
 	}
 
-	r.RemoveNode("192.168.1.3")
-	nodes, err = r.GetNodes("key1", 3)
+	r.ReplaceAllNodes(map[string]int{"192.168.1.2": 3})
+	checkEqual(r.NodeCount(), 1, t)
+	checkEqual(countCubes(r, "192.168.1.2"), 3*DefaultVirtualCubes, t)
+	checkEqual(len(r.sortedRing), 3*DefaultVirtualCubes, t)
+}
+
+func TestHashRing_AddNodesStaged(t *testing.T) {
+	batch := make(map[string]int)
+	for i := 1; i <= 20; i++ {
+		batch["192.168.1."+strconv.Itoa(i)] = i%3 + 1
+	}
+	r1, r2 := NewHashRing(), NewHashRing()
+	r1.AddNode("192.168.1.1", 5)
+	r2.AddNode("192.168.1.1", 5)
+	a1, u1, _ := r1.AddNodes(batch)
+	a2, u2, err := r2.AddNodesStaged(batch)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(nodes) != 3 {
-		t.Error("expected 3 members instead of", len(nodes))
+	if fmt.Sprint(a1, u1) != fmt.Sprint(a2, u2) {
+		t.Error("got", a2, u2, ", expected", a1, u1)
 	}
-	if nodes[0] != "192.168.1.5" {
-		t.Error("First node error, expected 192.168.1.3, but got", nodes[0])
+	if fmt.Sprint(r1.Entries()) != fmt.Sprint(r2.Entries()) {
+		t.Error("staged ring differs from AddNodes")
 	}
-	if nodes[1] != "192.168.1.7" {
-		t.Error("Second node error, expected 192.168.1.5, but got", nodes[1])
+	checkEqual(len(r2.sortedRing), len(r2.ring), t)
+
+	if _, _, err := r2.AddNodesStaged(map[string]int{"": 1}); err == nil {
+		t.Error("expected an error for an empty node id")
 	}
-	if nodes[2] != "192.168.1.8" {
-		t.Error("Third node error, expected 192.168.1.7, but got", nodes[2])
+}
+
+func TestHashRing_AddNodesStagedConcurrent(t *testing.T) {
+	r := NewHashRing()
+	r.AddNode("192.168.0.1", 1)
+	batch := make(map[string]int)
+	for i := 0; i < 200; i++ {
+		batch["10.0."+strconv.Itoa(i/250)+"."+strconv.Itoa(i%250)] = 4
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := r.GetNode("key" + strconv.Itoa(i)); err != nil {
+					t.Error(err)
+					return
+				}
+				r.NodeCount()
+			}
+		}()
+	}
+	r.AddNodesStaged(batch)
+	close(done)
+	wg.Wait()
+
+	checkEqual(r.NodeCount(), 201, t)
+	checkEqual(r.VirtualNodeCount(), len(r.sortedRing), t)
+}
+
+func TestHashRing_CollisionsDeterministic(t *testing.T) {
+	hash := func(data []byte) uint32 { return crc32.ChecksumIEEE(data) % 1000 }
+	ips := []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"}
+	build := func(order []int) *HashRing {
+		r := NewHashRing(WithHashFunc(hash))
+		for _, i := range order {
+			r.AddNode(ips[i], i+1)
+		}
+		return r
+	}
+	same := func(r1, r2 *HashRing) bool {
+		return fmt.Sprint(r1.ring) == fmt.Sprint(r2.ring) && fmt.Sprint(r1.sortedRing) == fmt.Sprint(r2.sortedRing)
+	}
+
+	r := build([]int{0, 1, 2, 3})
+	if r.CollisionCount() == 0 {
+		t.Fatal("expected collisions")
+	}
+	if !same(r, build([]int{3, 2, 1, 0})) || !same(r, build([]int{2, 0, 3, 1})) {
+		t.Error("add order changes the ring")
+	}
+	bulk := NewHashRing(WithHashFunc(hash))
+	bulk.AddNodes(map[string]int{ips[0]: 1, ips[1]: 2, ips[2]: 3, ips[3]: 4})
+	if !same(r, bulk) {
+		t.Error("AddNodes differs from AddNode")
+	}
+
+	// removing a node gives back the cubes it won to the other claims
+	r.RemoveNode(ips[1])
+	if !same(r, build([]int{0, 2, 3})) {
+		t.Error("ring after removal differs from a ring built without the node")
+	}
+	r.UpdateWeight(ips[0], 3)
+	r.UpdateWeight(ips[0], 1)
+	if !same(r, build([]int{3, 0, 2})) {
+		t.Error("weight round trip changes the ring")
+	}
+	r.RemoveNodes([]string{ips[0], ips[2], ips[3]})
+	checkEqual(len(r.ring), 0, t)
+	checkEqual(len(r.collisions), 0, t)
+}
+
+func TestHashRing_RemoveNode(t *testing.T) {
+	r := InitHashRing()
+	r.AddNode("192.168.1.10", 1)
+	r.RemoveNode("192.168.1.10")
+	checkEqual(len(r.ring), 0, t)
+	checkEqual(len(r.sortedRing), 0, t)
+
+	Nodes := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		ip := "192.168.1." + strconv.Itoa(i+1)
+		Nodes[ip] = i + 1
 	}
+	r.AddNodes(Nodes)
+	checkEqual(len(r.ring), 7040, t)
+	r.RemoveNode("192.168.1.10")
+	checkEqual(len(r.ring), 5760, t)
+}
+
+func countCubes(r *HashRing, ip string) int {
+	count := 0
+	for _, node := range r.ring {
+		if node == ip {
+			count++
+		}
+	}
+	return count
+}
+
+func TestHashRing_AddNodeWithCubes(t *testing.T) {
+	r := InitHashRing()
+	r.AddNodeWithCubes("192.168.1.1", 1, 10)
+	r.AddNodeWithCubes("192.168.1.2", 2, 300)
+	r.AddNode("192.168.1.3", 1)
+	checkEqual(countCubes(r, "192.168.1.1"), 10, t)
+	checkEqual(countCubes(r, "192.168.1.2"), 600, t)
+	checkEqual(countCubes(r, "192.168.1.3"), DefaultVirtualCubes, t)
+
+	r.UpdateWeight("192.168.1.1", 3)
+	checkEqual(countCubes(r, "192.168.1.1"), 30, t)
+
+	// re-adding a node keeps its cubes per weight on every path
+	r.AddNode("192.168.1.1", 2)
+	checkEqual(countCubes(r, "192.168.1.1"), 20, t)
+	r.AddNodes(map[string]int{"192.168.1.1": 4})
+	checkEqual(countCubes(r, "192.168.1.1"), 40, t)
+	r.AddNodeMeta("192.168.1.1", 5, nil)
+	checkEqual(countCubes(r, "192.168.1.1"), 50, t)
+	r.AddNodeStats("192.168.1.1", 3)
+	checkEqual(countCubes(r, "192.168.1.1"), 30, t)
+	checkEqual(r.cubes["192.168.1.1"], 10, t)
+
+	r.RemoveNode("192.168.1.2")
+	checkEqual(countCubes(r, "192.168.1.2"), 0, t)
+	checkEqual(len(r.ring), 30+DefaultVirtualCubes, t)
+	r.RemoveNodes([]string{"192.168.1.1"})
+	checkEqual(len(r.ring), DefaultVirtualCubes, t)
+	checkEqual(len(r.sortedRing), DefaultVirtualCubes, t)
+}
+
+func TestHashRing_RemoveAbsentNode(t *testing.T) {
+	r := InitHashRing()
+	r.AddNode("192.168.1.1", 1)
+	snapshot, sortedRing := r.loadSnapshot(), r.sortedRing
+
+	if r.RemoveNode("192.168.1.2") {
+		t.Error("RemoveNode reported an absent node as removed")
+	}
+	if r.loadSnapshot() != snapshot || &r.sortedRing[0] != &sortedRing[0] {
+		t.Error("removing an absent node rebuilt the ring")
+	}
+	checkEqual(len(r.ring), DefaultVirtualCubes, t)
+
+	if !r.RemoveNode("192.168.1.1") {
+		t.Error("RemoveNode reported a present node as absent")
+	}
+	checkEqual(len(r.ring), 0, t)
+}
+
+func TestHashRing_RemoveByPrefix(t *testing.T) {
+	r := NewHashRing()
+	var notified []string
+	r.OnRemove(func(ip string) { notified = append(notified, ip) })
+	r.AddNode("web-0", 1)
+	r.AddNode("web-1", 2)
+	r.AddNode("db-0", 1)
+
+	checkEqual(r.RemoveByPrefix("web-"), 2, t)
+	if fmt.Sprint(r.Members()) != "[db-0]" {
+		t.Error("got members", r.Members(), ", expected [db-0]")
+	}
+	if fmt.Sprint(notified) != "[web-0 web-1]" {
+		t.Error("notified", notified, ", expected [web-0 web-1]")
+	}
+	checkEqual(len(r.sortedRing), DefaultVirtualCubes, t)
+	checkEqual(len(r.Weights()), 1, t)
+	if err := r.Verify(); err != nil {
+		t.Error(err)
+	}
+	checkEqual(r.RemoveByPrefix("web-"), 0, t)
+}
+
+func TestHashRing_RemoveNodes(t *testing.T) {
+	r := InitHashRing()
+	Nodes := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		Nodes["192.168.1."+strconv.Itoa(i+1)] = 1
+	}
+	r.AddNodes(Nodes)
+
+	rebuilds := 0
+	testHookUpdateSortedRing = func() { rebuilds++ }
+	defer func() { testHookUpdateSortedRing = nil }()
+
+	r.RemoveNodes([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4", "192.168.1.5", "10.0.0.1"})
+	checkEqual(rebuilds, 1, t)
+	checkEqual(len(r.ring), DefaultVirtualCubes*5, t)
+	checkEqual(len(r.sortedRing), DefaultVirtualCubes*5, t)
+	checkEqual(r.NodeCount(), 5, t)
+	if r.HasNode("192.168.1.1") || !r.HasNode("192.168.1.6") {
+		t.Error("wrong nodes removed:", r.Members())
+	}
+}
+
+func TestHashRing_Uninitialized(t *testing.T) {
+	var nilRing *HashRing
+	for _, r := range []*HashRing{nilRing, {}} {
+		if _, err := r.GetNode("key1"); err != ErrEmptyRing {
+			t.Error("GetNode got", err, ", expected", ErrEmptyRing)
+		}
+		if _, err := r.GetNodes("key1", 2); err != ErrEmptyRing {
+			t.Error("GetNodes got", err, ", expected", ErrEmptyRing)
+		}
+		if _, _, err := r.GetNodeMeta("key1"); err != ErrEmptyRing {
+			t.Error("GetNodeMeta got", err, ", expected", ErrEmptyRing)
+		}
+		if _, err := r.GetWeightedNodes("key1", 2); err != ErrEmptyRing {
+			t.Error("GetWeightedNodes got", err, ", expected", ErrEmptyRing)
+		}
+		if _, err := r.Snapshot().GetNode("key1"); err != ErrEmptyRing {
+			t.Error("Snapshot().GetNode got", err, ", expected", ErrEmptyRing)
+		}
+		if len(r.Members()) != 0 || len(r.Weights()) != 0 || len(r.Entries()) != 0 {
+			t.Error("expected no member")
+		}
+		checkEqual(r.NodeCount(), 0, t)
+		checkEqual(r.VirtualNodeCount(), 0, t)
+		if r.HasNode("192.168.1.1") || r.RemoveNode("192.168.1.1") {
+			t.Error("expected no node")
+		}
+		if stats := r.Stats(); stats != (RingStats{}) {
+			t.Error("got stats", stats)
+		}
+
+		if err := r.AddNode("192.168.1.1", 1); err != ErrNotInitialized {
+			t.Error("AddNode got", err, ", expected", ErrNotInitialized)
+		}
+		if _, _, err := r.AddNodes(map[string]int{"192.168.1.1": 1}); err != ErrNotInitialized {
+			t.Error("AddNodes got", err, ", expected", ErrNotInitialized)
+		}
+		if err := r.UpdateWeight("192.168.1.1", 2); err != ErrNotInitialized {
+			t.Error("UpdateWeight got", err, ", expected", ErrNotInitialized)
+		}
+		r.RemoveNodes([]string{"192.168.1.1"})
+		r.Clear()
+		if err := r.AddNode("192.168.1.1", 1); err != ErrNotInitialized {
+			t.Error("AddNode after Clear got", err, ", expected", ErrNotInitialized)
+		}
+		if n, err := r.EstimateRemap("192.168.1.1", 1, []string{"key1"}); n != 0 || err != ErrNotInitialized {
+			t.Error("EstimateRemap got", n, err, ", expected", ErrNotInitialized)
+		}
+		if _, err := r.MigrationPlan(map[string]int{"192.168.1.1": 1}); err != ErrNotInitialized {
+			t.Error("MigrationPlan got", err, ", expected", ErrNotInitialized)
+		}
+		if err := r.ReplaceAllNodes(nil); err != ErrNotInitialized {
+			t.Error("ReplaceAllNodes got", err, ", expected", ErrNotInitialized)
+		}
+		if r.Hash("key1") != crc32.ChecksumIEEE([]byte("key1")) {
+			t.Error("Hash got", r.Hash("key1"), ", expected the CRC32 of key1")
+		}
+		if r.Testing().DisablePoint(r.Hash("key1")) {
+			t.Error("DisablePoint disabled a cube of an empty ring")
+		}
+		r.Testing().EnablePoint(r.Hash("key1"))
+	}
+
+	if nilRing.Clone() != nil {
+		t.Error("Clone of a nil ring is not nil")
+	}
+	// a clone of an uninitialized ring stays uninitialized
+	c := (&HashRing{}).Clone()
+	if err := c.AddNode("192.168.1.1", 1); err != ErrNotInitialized {
+		t.Error("AddNode on a clone got", err, ", expected", ErrNotInitialized)
+	}
+	checkEqual(c.NodeCount(), 0, t)
+	if _, err := nilRing.EstimateRemap("192.168.1.1", 1, nil); err != ErrNotInitialized {
+		t.Error("EstimateRemap got", err, ", expected", ErrNotInitialized)
+	}
+	if err := nilRing.Dump(io.Discard, 0); err != ErrNotInitialized {
+		t.Error("Dump got", err, ", expected", ErrNotInitialized)
+	}
+	if _, err := nilRing.WriteTo(io.Discard); err != ErrNotInitialized {
+		t.Error("WriteTo got", err, ", expected", ErrNotInitialized)
+	}
+	if _, err := nilRing.MarshalJSON(); err != ErrNotInitialized {
+		t.Error("MarshalJSON got", err, ", expected", ErrNotInitialized)
+	}
+	if _, err := nilRing.GobEncode(); err != ErrNotInitialized {
+		t.Error("GobEncode got", err, ", expected", ErrNotInitialized)
+	}
+	if err := nilRing.UnmarshalJSON([]byte(`{"weights":{"a":1}}`)); err != ErrNotInitialized {
+		t.Error("UnmarshalJSON got", err, ", expected", ErrNotInitialized)
+	}
+	if err := nilRing.GobDecode(nil); err != ErrNotInitialized {
+		t.Error("GobDecode got", err, ", expected", ErrNotInitialized)
+	}
+	if _, err := nilRing.ReadFrom(bytes.NewReader(nil)); err != ErrNotInitialized {
+		t.Error("ReadFrom got", err, ", expected", ErrNotInitialized)
+	}
+}
+
+func TestHashRing_Clear(t *testing.T) {
+	r := NewHashRing(WithVirtualCubes(10), WithHashFunc(fnv32a))
+	for i := 0; i < 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i+1), i+1)
+	}
+	r.Clear()
+	checkEqual(r.NodeCount(), 0, t)
+	checkEqual(len(r.ring), 0, t)
+	checkEqual(len(r.sortedRing), 0, t)
+	if _, err := r.GetNode("key1"); err == nil {
+		t.Error("expected error on cleared ring")
+	}
+
+	r.AddNode("192.168.1.1", 2)
+	checkEqual(r.NodeCount(), 1, t)
+	checkEqual(len(r.ring), 20, t)
+	if node, err := r.GetNode("key1"); err != nil || node != "192.168.1.1" {
+		t.Error("got", node, err, ", expected 192.168.1.1")
+	}
+	if r.generateHash("key1") != fnv32a([]byte("key1")) {
+		t.Error("Clear dropped the hash function")
+	}
+}
+
+func TestHashRing_UpdateWeight(t *testing.T) {
+	r := InitHashRing()
+	r.AddNode("192.168.1.1", 2)
+	r.AddNode("192.168.1.2", 1)
+
+	if err := r.UpdateWeight("192.168.1.1", 5); err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(countCubes(r, "192.168.1.1"), DefaultVirtualCubes*5, t)
+	checkEqual(countCubes(r, "192.168.1.2"), DefaultVirtualCubes, t)
+	checkEqual(len(r.sortedRing), DefaultVirtualCubes*6, t)
+	checkEqual(r.weights["192.168.1.1"], 5, t)
+
+	if err := r.UpdateWeight("192.168.1.1", 3); err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(countCubes(r, "192.168.1.1"), DefaultVirtualCubes*3, t)
+	checkEqual(countCubes(r, "192.168.1.2"), DefaultVirtualCubes, t)
+	checkEqual(len(r.sortedRing), DefaultVirtualCubes*4, t)
+
+	if err := r.UpdateWeight("192.168.1.1", 3); err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(len(r.ring), DefaultVirtualCubes*4, t)
+
+	if err := r.UpdateWeight("192.168.1.3", 1); err == nil {
+		t.Error("expected error when updating an absent node")
+	}
+}
+
+func TestHashRing_Clone(t *testing.T) {
+	r := InitHashRing()
+	r.AddNode("192.168.1.1", 1)
+	r.AddNode("192.168.1.2", 2)
+
+	c := r.Clone()
+	checkEqual(len(c.ring), len(r.ring), t)
+	checkEqual(len(c.sortedRing), len(r.sortedRing), t)
+	checkEqual(c.numberOfCubes, r.numberOfCubes, t)
+
+	c.AddNode("192.168.1.3", 3)
+	c.RemoveNode("192.168.1.1")
+	checkEqual(len(r.ring), DefaultVirtualCubes*3, t)
+	checkEqual(len(r.sortedRing), DefaultVirtualCubes*3, t)
+	checkEqual(len(r.Members()), 2, t)
+	if !r.HasNode("192.168.1.1") || r.HasNode("192.168.1.3") {
+		t.Error("mutating the clone changed the original members")
+	}
+	checkEqual(len(c.ring), DefaultVirtualCubes*5, t)
+
+	r.UpdateWeight("192.168.1.2", 5)
+	checkEqual(c.weights["192.168.1.2"], 2, t)
+	checkEqual(countCubes(c, "192.168.1.2"), DefaultVirtualCubes*2, t)
+}
+
+func TestHashRing_IncrementalSortedRing(t *testing.T) {
+	r := InitHashRing()
+	for i := 0; i < 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i+1), i%3+1)
+	}
+	r.RemoveNode("192.168.1.4")
+	r.UpdateWeight("192.168.1.1", 5)
+	r.AddNode("192.168.1.4", 2)
+	r.UpdateWeight("192.168.1.9", 1)
+	r.RemoveNode("192.168.1.10")
+
+	if !sort.IsSorted(r.sortedRing) {
+		t.Error("expected sorted ring to be sorted")
+	}
+	checkEqual(len(r.sortedRing), len(r.ring), t)
+	expected := r.sortedRing
+	r.updateSortedRing()
+	if fmt.Sprint(expected) != fmt.Sprint(r.sortedRing) {
+		t.Error("incremental sorted ring differs from a full rebuild")
+	}
+}
+
+func benchmarkRing(nodes int) *HashRing {
+	r := NewHashRing()
+	Nodes := make(map[string]int)
+	for i := 0; i < nodes; i++ {
+		Nodes["10.0."+strconv.Itoa(i/256)+"."+strconv.Itoa(i%256)] = 1
+	}
+	r.AddNodes(Nodes)
+	return r
+}
+
+func BenchmarkHashRing_AddRemoveIncremental(b *testing.B) {
+	r := benchmarkRing(1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.AddNode("192.168.1.1", 1)
+		r.RemoveNode("192.168.1.1")
+	}
+}
+
+func BenchmarkHashRing_AddRemoveFullRebuild(b *testing.B) {
+	r := benchmarkRing(1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.AddNodes(map[string]int{"192.168.1.1": 1})
+		r.RemoveNodes([]string{"192.168.1.1"})
+	}
+}
+
+func TestHashRing_Callbacks(t *testing.T) {
+	r := InitHashRing()
+	var events []string
+	r.OnAdd(func(ip string) { events = append(events, "add1 "+ip) })
+	r.OnAdd(func(ip string) { events = append(events, "add2 "+ip) })
+	r.OnRemove(func(ip string) {
+		// callbacks run outside the lock and may use the ring
+		if r.HasNode(ip) {
+			t.Error(ip, "still in the ring")
+		}
+		events = append(events, "remove "+ip)
+	})
+
+	r.AddNode("192.168.1.1", 1)
+	r.AddNodes(map[string]int{"192.168.1.2": 1})
+	r.RemoveNode("192.168.1.1")
+	r.RemoveNode("192.168.1.3")
+	r.RemoveNodes([]string{"192.168.1.2", "192.168.1.3"})
+
+	expected := []string{
+		"add1 192.168.1.1", "add2 192.168.1.1",
+		"add1 192.168.1.2", "add2 192.168.1.2",
+		"remove 192.168.1.1",
+		"remove 192.168.1.2",
+	}
+	if fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Error("events", events, ", expected", expected)
+	}
+}
+
+func TestHashRing_Members(t *testing.T) {
+	r := InitHashRing()
+	Nodes := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		ip := "192.168.1." + strconv.Itoa(i+1)
+		Nodes[ip] = i + 1
+	}
+	r.AddNodes(Nodes)
+	checkEqual(len(r.Members()), 10, t)
+}
+
+func TestHashRing_SortedMembers(t *testing.T) {
+	r := InitHashRing()
+	checkEqual(len(r.SortedMembers()), 0, t)
+	for i := 0; i < 20; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i+1), 1)
+	}
+
+	m1, m2 := r.SortedMembers(), r.SortedMembers()
+	checkEqual(len(m1), 20, t)
+	if fmt.Sprint(m1) != fmt.Sprint(m2) {
+		t.Error("SortedMembers is not deterministic:", m1, m2)
+	}
+	if !sort.StringsAreSorted(m1) {
+		t.Error("expected members to be sorted:", m1)
+	}
+}
+
+func TestHashRing_HasNode(t *testing.T) {
+	var nilRing *HashRing
+	r := InitHashRing()
+	r.AddNode("192.168.1.1", 1)
+	r.AddNode("192.168.1.2", 2)
+
+	testHas := []struct {
+		ring  *HashRing
+		ip    string
+		has   bool
+		count int
+	}{
+		{r, "192.168.1.1", true, 2},
+		{r, "192.168.1.2", true, 2},
+		{r, "192.168.1.3", false, 2},
+		{NewHashRing(), "192.168.1.1", false, 0},
+		{nilRing, "192.168.1.1", false, 0},
+	}
+	for i, v := range testHas {
+		if v.ring.HasNode(v.ip) != v.has {
+			t.Error("index", i, "err: HasNode", v.ip, "expected", v.has)
+		}
+		checkEqual(v.ring.NodeCount(), v.count, t)
+	}
+}
+
+func TestHashRing_Weights(t *testing.T) {
+	r := InitHashRing()
+	r.AddNode("192.168.1.1", 1)
+	r.AddNode("192.168.1.2", 3)
+
+	if weight, ok := r.Weight("192.168.1.2"); !ok || weight != 3 {
+		t.Error("got", weight, ok, ", expected 3 true")
+	}
+	if weight, ok := r.Weight("192.168.1.3"); ok || weight != 0 {
+		t.Error("got", weight, ok, ", expected 0 false")
+	}
+
+	w := r.Weights()
+	checkEqual(len(w), 2, t)
+	checkEqual(w["192.168.1.1"], 1, t)
+	w["192.168.1.1"] = 10
+	w["192.168.1.3"] = 1
+	if weight, _ := r.Weight("192.168.1.1"); weight != 1 {
+		t.Error("mutating Weights changed the ring")
+	}
+	checkEqual(len(r.Weights()), 2, t)
+}
+
+func TestHashRing_GetNode(t *testing.T) {
+	testGet := []struct {
+		in, out string
+	}{
+		{"key1", "192.168.1.3"},
+		{"key2", "192.168.1.7"},
+		{"key3", "192.168.1.7"},
+		{"key4", "192.168.1.9"},
+		{"key5", "192.168.1.10"},
+	}
+	testGetAfterRemove := []struct {
+		in, out string
+	}{
+		{"key1", "192.168.1.3"},
+		{"key2", "192.168.1.7"},
+		{"key3", "192.168.1.7"},
+		{"key4", "192.168.1.9"},
+		{"key5", "192.168.1.3"},
+	}
+
+	r := InitHashRing()
+	Nodes := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		ip := "192.168.1." + strconv.Itoa(i+1)
+		Nodes[ip] = i + 1
+	}
+	r.AddNodes(Nodes)
+
+	for i, v := range testGet {
+		node, err := r.GetNode(v.in)
+		if err != nil {
+			t.Fatal(i, "err: ", err)
+		}
+		if node != v.out {
+			t.Error("index", i, "err: got", node, ", expected", v.out)
+		}
+	}
+
+	r.RemoveNode("192.168.1.10")
+	for i, v := range testGetAfterRemove {
+		node, err := r.GetNode(v.in)
+		if err != nil {
+			t.Fatal(i, "err: ", err)
+		}
+		if node != v.out {
+			t.Error("index", i, "err: got", node, ", expected", v.out)
+		}
+	}
+}
+
+func TestHashRing_GetNodesWithDistance(t *testing.T) {
+	r := NewHashRing()
+	if _, err := r.GetNodesWithDistance("key1", 3); err != ErrEmptyRing {
+		t.Error("empty ring got", err, ", expected", ErrEmptyRing)
+	}
+	for i := 0; i < 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i+1), i+1)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		got, err := r.GetNodesWithDistance(key, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes, _ := r.GetNodes(key, 4)
+		checkEqual(len(got), len(nodes), t)
+		for j := range got {
+			if got[j].Node != nodes[j] {
+				t.Error(key, "got", got[j].Node, ", expected", nodes[j])
+			}
+			if j > 0 && got[j].Distance < got[j-1].Distance {
+				t.Error(key, "distance", got[j].Distance, "after", got[j-1].Distance)
+			}
+		}
+		_, point, _ := r.GetNodeDetail(key)
+		if gap := point - r.Hash(key); got[0].Distance != gap {
+			t.Error(key, "first distance", got[0].Distance, ", expected", gap)
+		}
+	}
+
+	if got, _ := r.GetNodesWithDistance("key1", 20); len(got) != 10 {
+		t.Error("got", len(got), "nodes, expected 10")
+	}
+	if got, err := r.GetNodesWithDistance("key1", -1); err != nil || len(got) != 0 {
+		t.Error("negative n got", got, err)
+	}
+
+	// distances wrap around the narrowed keyspace
+	narrow := NewHashRing(WithKeyspaceBits(16), WithVirtualCubes(4))
+	for i := 0; i < 10; i++ {
+		narrow.AddNode("192.168.1."+strconv.Itoa(i+1), 1)
+	}
+	wrapped := false
+	for i := 0; i < 1000; i++ {
+		key := "key" + strconv.Itoa(i)
+		got, err := narrow.GetNodesWithDistance(key, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range got {
+			if got[j].Distance >= 1<<16 {
+				t.Fatal(key, "distance", got[j].Distance, "out of the 16-bit keyspace")
+			}
+			if j > 0 && got[j].Distance < got[j-1].Distance {
+				t.Error(key, "distance", got[j].Distance, "after", got[j-1].Distance)
+			}
+		}
+		_, point, _ := narrow.GetNodeDetail(key)
+		if point < narrow.Hash(key) {
+			wrapped = true
+		}
+		if gap := (point - narrow.Hash(key)) % (1 << 16); got[0].Distance != gap {
+			t.Error(key, "first distance", got[0].Distance, ", expected", gap)
+		}
+	}
+	if !wrapped {
+		t.Error("no key wrapped around the keyspace")
+	}
+}
+
+func TestHashRing_GetNodesInto(t *testing.T) {
+	r := NewHashRing()
+	dst := []string{"stale"}
+	if nodes, err := r.GetNodesInto("key1", 3, dst); err != ErrEmptyRing || len(nodes) != 0 {
+		t.Error("empty ring got", nodes, err)
+	}
+	for i := 1; i <= 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i), i%3+1)
+	}
+
+	dst = make([]string, 0, 3)
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		for _, n := range []int{1, 3, 20} {
+			nodes, _ := r.GetNodesInto(key, n, dst)
+			expected, _ := r.GetNodes(key, n)
+			if fmt.Sprint(nodes) != fmt.Sprint(expected) {
+				t.Fatal(key, n, "got", nodes, ", expected", expected)
+			}
+			if n <= 3 && &nodes[0] != &dst[:1][0] {
+				t.Error(key, n, "did not reuse dst")
+			}
+		}
+	}
+}
+
+func TestHashRing_GetNodesStrict(t *testing.T) {
+	r := NewHashRing()
+	if _, err := r.GetNodesStrict("key1", 1); err != ErrEmptyRing {
+		t.Error("empty ring got", err, ", expected", ErrEmptyRing)
+	}
+	for i := 1; i <= 3; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i), 1)
+	}
+
+	// GetNodes caps n to the number of nodes
+	nodes, err := r.GetNodes("key1", 5)
+	if err != nil || len(nodes) != 3 {
+		t.Error("GetNodes got", nodes, err)
+	}
+
+	strict, err := r.GetNodesStrict("key1", 3)
+	if err != nil || fmt.Sprint(strict) != fmt.Sprint(nodes) {
+		t.Error("got", strict, err, ", expected", nodes)
+	}
+	strict, err = r.GetNodesStrict("key1", 5)
+	if !errors.Is(err, ErrNotEnoughNodes) {
+		t.Error("got", err, ", expected", ErrNotEnoughNodes)
+	}
+	if fmt.Sprint(strict) != fmt.Sprint(nodes) {
+		t.Error("got", strict, ", expected", nodes)
+	}
+}
+
+func TestHashRing_GetNodesUniformOrder(t *testing.T) {
+	r := NewHashRing()
+	if _, err := r.GetNodesUniformOrder("key1", 2); err != ErrEmptyRing {
+		t.Error("empty ring got", err, ", expected", ErrEmptyRing)
+	}
+	r.AddNode("192.168.1.100", 10)
+	for i := 1; i <= 9; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i), 1)
+	}
+
+	// the heavy node comes first for about 10/19 of the keys with GetNodes,
+	// and for about 1/10 of them in uniform order
+	weighted, uniform := 0, 0
+	for i := 0; i < 10000; i++ {
+		key := "key" + strconv.Itoa(i)
+		nodes, _ := r.GetNodes(key, 3)
+		if nodes[0] == "192.168.1.100" {
+			weighted++
+		}
+		nodes, err := r.GetNodesUniformOrder(key, 3)
+		if err != nil || len(nodes) != 3 {
+			t.Fatal(key, "got", nodes, err)
+		}
+		if nodes[0] == "192.168.1.100" {
+			uniform++
+		}
+	}
+	if weighted < 4000 {
+		t.Error("heavy node first for", weighted, "keys with GetNodes, expected about 5263")
+	}
+	if uniform < 500 || uniform > 1500 {
+		t.Error("heavy node first for", uniform, "keys in uniform order, expected about 1000")
+	}
+
+	all, _ := r.GetNodesUniformOrder("key1", 20)
+	sort.Strings(all)
+	if fmt.Sprint(all) != fmt.Sprint(r.SortedMembers()) {
+		t.Error("got", all, ", expected", r.SortedMembers())
+	}
+}
+
+func TestHashRing_GetNodeNS(t *testing.T) {
+	r := NewHashRing()
+	if _, err := r.GetNodeNS("a", "bc"); err != ErrEmptyRing {
+		t.Error("empty ring got", err, ", expected", ErrEmptyRing)
+	}
+	for i := 1; i <= 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i), 1)
+	}
+
+	if string(namespacedKey("a", "bc")) == string(namespacedKey("ab", "c")) {
+		t.Fatal("(a, bc) and (ab, c) share a key")
+	}
+	if r.hashBytes(namespacedKey("a", "bc")) == r.hashBytes(namespacedKey("ab", "c")) {
+		t.Error("(a, bc) and (ab, c) share a hash")
+	}
+
+	// a plain concatenation would always give the same node
+	differ := 0
+	for i := 0; i < 100; i++ {
+		name := strconv.Itoa(i)
+		n1, _ := r.GetNodeNS("tenant", "a"+name)
+		n2, _ := r.GetNodeNS("tenanta", name)
+		if n1 != n2 {
+			differ++
+		}
+		if expected, _ := r.GetNodeBytes(namespacedKey("tenant", "a"+name)); n1 != expected {
+			t.Error("got", n1, ", expected", expected)
+		}
+	}
+	if differ < 50 {
+		t.Error("only", differ, "of 100 names differ between namespaces")
+	}
+}
+
+func TestHashRing_GetNodeDetail(t *testing.T) {
+	r := InitHashRing()
+	if _, _, err := r.GetNodeDetail("key1"); err == nil {
+		t.Error("expected error on empty ring")
+	}
+	for i := 0; i < 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i+1), i+1)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		node, point, err := r.GetNodeDetail(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, _ := r.GetNode(key); node != expected {
+			t.Error(key, "got", node, ", expected", expected)
+		}
+
+		// the smallest cube above the hash, or the first cube after wrapping
+		hash := r.generateHash(key)
+		expected := r.sortedRing[0]
+		for _, h := range r.sortedRing {
+			if h > hash {
+				expected = h
+				break
+			}
+		}
+		if point != expected {
+			t.Errorf("%s err: got point %#x, expected %#x", key, point, expected)
+		}
+		if r.ring[point] != node {
+			t.Error(key, "point", point, "is not a cube of", node)
+		}
+	}
+}
+
+func TestHashRing_GetNodeCtx(t *testing.T) {
+	r := InitHashRing()
+	r.AddNode("192.168.1.1", 1)
+	node, err := r.GetNodeCtx(context.Background(), "key1")
+	if err != nil || node != "192.168.1.1" {
+		t.Error("got", node, err, ", expected 192.168.1.1")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = r.GetNodeCtx(ctx, "key1"); err != ctx.Err() {
+		t.Error("got", err, ", expected", ctx.Err())
+	}
+	if _, err = InitHashRing().GetNodeCtx(ctx, "key1"); err != ctx.Err() {
+		t.Error("empty ring: got", err, ", expected", ctx.Err())
+	}
+}
+
+func TestHashRing_ErrEmptyRing(t *testing.T) {
+	r := NewHashRing()
+	if _, err := r.GetNode("key1"); !errors.Is(err, ErrEmptyRing) {
+		t.Error("GetNode got", err)
+	}
+	if _, err := r.GetNodes("key1", 3); !errors.Is(err, ErrEmptyRing) {
+		t.Error("GetNodes got", err)
+	}
+	if _, err := r.GetNodeBytes([]byte("key1")); !errors.Is(err, ErrEmptyRing) {
+		t.Error("GetNodeBytes got", err)
+	}
+	if _, err := NewHashRing64().GetNode("key1"); !errors.Is(err, ErrEmptyRing) {
+		t.Error("HashRing64 got", err)
+	}
+	if _, err := NewRendezvousRing().GetNode("key1"); !errors.Is(err, ErrEmptyRing) {
+		t.Error("RendezvousRing got", err)
+	}
+
+	r.AddNode("192.168.1.1", 1)
+	err := r.UpdateWeight("192.168.1.2", 2)
+	if !errors.Is(err, ErrNodeNotFound) || !strings.Contains(err.Error(), "192.168.1.2") {
+		t.Error("UpdateWeight got", err)
+	}
+	if _, err := r.DrainNode("192.168.1.2", 2)(); !errors.Is(err, ErrNodeNotFound) {
+		t.Error("DrainNode got", err)
+	}
+
+	empty := NewHashRing()
+	allocs := testing.AllocsPerRun(100, func() {
+		empty.GetNode("key1")
+	})
+	if allocs != 0 {
+		t.Error("lookup on an empty ring allocs got", allocs, ", expected 0")
+	}
+}
+
+func TestHashRing_GetNodeForHash(t *testing.T) {
+	r := InitHashRing()
+	if _, err := r.GetNodeForHash(0); err == nil {
+		t.Error("expected error on empty ring")
+	}
+	for i := 0; i < 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i+1), i+1)
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		expected, _ := r.GetNode(key)
+		node, err := r.GetNodeForHash(r.Hash(key))
+		if err != nil || node != expected {
+			t.Error(key, "got", node, err, ", expected", expected)
+		}
+	}
+}
+
+func TestHashRing_Hash(t *testing.T) {
+	r := NewHashRing()
+	for _, key := range []string{"", "key1", "192.168.1.1#0"} {
+		if got, expected := r.Hash(key), crc32.ChecksumIEEE([]byte(key)); got != expected {
+			t.Error(key, "got", got, ", expected", expected)
+		}
+	}
+	if got := NewHashRing(WithHashFunc(Murmur3Hash)).Hash("key1"); got != Murmur3Hash([]byte("key1")) {
+		t.Error("custom hash got", got)
+	}
+	if NewHashRing(WithSeed(1)).Hash("key1") == r.Hash("key1") {
+		t.Error("seeded hash equals the unseeded one")
+	}
+}
+
+func TestHashRing_HashSetHashFunc(t *testing.T) {
+	r := NewHashRing()
+	r.SetHashFunc(Murmur3Hash)
+	if got := r.Hash("key1"); got != Murmur3Hash([]byte("key1")) {
+		t.Error("hash after SetHashFunc got", got)
+	}
+
+	// lookups and Hash do not race with SetHashFunc on an emptied ring
+	r.AddNode("192.168.1.1", 1)
+	view := r.Snapshot()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			r.Hash("key1")
+			r.GetNode("key1")
+			view.GetNode("key1")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		r.RemoveNode("192.168.1.1")
+		for i := 0; i < 100; i++ {
+			r.SetHashFunc(fnv32a)
+		}
+	}()
+	wg.Wait()
+	if got, _ := view.GetNode("key1"); got != "192.168.1.1" {
+		t.Error("view got", got, ", expected 192.168.1.1")
+	}
+	if got := r.Hash("key1"); got != fnv32a([]byte("key1")) {
+		t.Error("hash after SetHashFunc got", got)
+	}
+}
+
+func TestHashRing_GetNodes(t *testing.T) {
+	r := InitHashRing()
+	if nodes, err := r.GetNodes("key1", 3); err == nil || nodes != nil {
+		t.Error("expected error and nil nodes on empty ring, got", nodes, err)
+	}
+
+	Nodes := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		ip := "192.168.1." + strconv.Itoa(i+1)
+		Nodes[ip] = i + 1
+	}
+	r.AddNodes(Nodes)
+
+	nodes, err := r.GetNodes("key1", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 3 {
+		t.Error("expected 3 members instead of", len(nodes))
+	}
+	if nodes[0] != "192.168.1.3" {
+		t.Error("First node error, expected 192.168.1.3, but got", nodes[0])
+	}
+	if nodes[1] != "192.168.1.5" {
+		t.Error("Second node error, expected 192.168.1.5, but got", nodes[1])
+	}
+	if nodes[2] != "192.168.1.7" {
+		t.Error("Third node error, expected 192.168.1.7, but got", nodes[2])
+	}
+
+	r.RemoveNode("192.168.1.3")
+	nodes, err = r.GetNodes("key1", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 3 {
+		t.Error("expected 3 members instead of", len(nodes))
+	}
+	if nodes[0] != "192.168.1.5" {
+		t.Error("First node error, expected 192.168.1.3, but got", nodes[0])
+	}
+	if nodes[1] != "192.168.1.7" {
+		t.Error("Second node error, expected 192.168.1.5, but got", nodes[1])
+	}
+	if nodes[2] != "192.168.1.8" {
+		t.Error("Third node error, expected 192.168.1.7, but got", nodes[2])
+	}
+}
+
+func TestHashRing_GetReplicas(t *testing.T) {
+	r := InitHashRing()
+	if _, err := r.GetReplicas("key1", 2); err == nil {
+		t.Error("expected error on empty ring")
+	}
+
+	for i := 0; i < 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i+1), i+1)
+	}
+	nodes, err := r.GetReplicas("key1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, _ := r.GetNode("key1")
+	if len(nodes) != 3 || nodes[0] != primary {
+		t.Error("got", nodes, ", expected primary", primary, "and 2 replicas")
+	}
+	expected, _ := r.GetNodes("key1", 3)
+	if fmt.Sprint(nodes) != fmt.Sprint(expected) {
+		t.Error("got", nodes, ", expected", expected)
+	}
+
+	nodes, _ = r.GetReplicas("key1", 20)
+	checkEqual(len(nodes), 10, t)
+	nodes, _ = r.GetReplicas("key1", 0)
+	if len(nodes) != 1 || nodes[0] != primary {
+		t.Error("got", nodes, ", expected only the primary", primary)
+	}
+}
+
+func TestHashRing_Walk(t *testing.T) {
+	r := InitHashRing()
+	next := r.Walk("key1")
+	if _, ok := next(); ok {
+		t.Error("expected empty walk on empty ring")
+	}
+
+	for i := 0; i < 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i+1), i+1)
+	}
+	for _, key := range []string{"key1", "key2", "key3"} {
+		expected, _ := r.GetNodes(key, 10)
+		next = r.Walk(key)
+		var walked []string
+		for node, ok := next(); ok; node, ok = next() {
+			walked = append(walked, node)
+		}
+		if fmt.Sprint(walked) != fmt.Sprint(expected) {
+			t.Error(key, "walked", walked, ", expected", expected)
+		}
+	}
+
+	// the iterator is not affected by later changes
+	next = r.Walk("key1")
+	r.RemoveNode("192.168.1.3")
+	count := 0
+	for _, ok := next(); ok; _, ok = next() {
+		count++
+	}
+	checkEqual(count, 10, t)
+}
+
+func TestHashRing_GetNodeSticky(t *testing.T) {
+	build := func(opts ...Option) *HashRing {
+		r := NewHashRing(append(opts, WithHashFunc(tableHash(map[string]uint32{
+			"a#0": 100,
+			"b#0": 200,
+			"c#0": 300,
+			"d#0": 1 << 31,
+			"key": 50,
+		})), WithVirtualCubes(1))...)
+		r.AddNodes(map[string]int{"a": 1, "b": 1, "c": 1, "d": 1})
+		return r
+	}
+	r := build()
+
+	for _, c := range []struct{ last, expected string }{
+		{"", "a"},
+		{"a", "a"},
+		{"c", "c"},
+		{"unknown", "a"},
+	} {
+		if got, _ := r.GetNodeSticky("key", c.last); got != c.expected {
+			t.Error("last", c.last, "got", got, ", expected", c.expected)
+		}
+	}
+
+	// c is beyond a window of 2 cubes
+	r = build(WithStickyWindow(2))
+	if got, _ := r.GetNodeSticky("key", "c"); got != "a" {
+		t.Error("far node got", got, ", expected a")
+	}
+	if got, _ := r.GetNodeSticky("key", "b"); got != "b" {
+		t.Error("near node got", got, ", expected b")
+	}
+	r.RemoveNode("b")
+	if got, _ := r.GetNodeSticky("key", "b"); got != "a" {
+		t.Error("removed node got", got, ", expected a")
+	}
+}
+
+func TestHashRing_GetNodeWithFallback(t *testing.T) {
+	r := NewHashRing()
+	r.AddNodes(map[string]int{"192.168.1.1": 1, "192.168.1.2": 1, "192.168.1.3": 1})
+	expected, _ := r.GetNodes("key1", 3)
+
+	tried := make(map[string]bool)
+	var got []string
+	for {
+		node, err := r.GetNodeWithFallback("key1", tried)
+		if err == ErrNoNodeAvailable {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) > 3 {
+			t.Fatal("no end of fallback after", got)
+		}
+		got = append(got, node)
+		tried[node] = true
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Error("tried", got, ", expected", expected)
+	}
+}
+
+func TestHashRing_GetNodeExcluding(t *testing.T) {
+	r := InitHashRing()
+	if _, err := r.GetNodeExcluding("key1", nil); err == nil {
+		t.Error("expected error on empty ring")
+	}
+	for i := 0; i < 5; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i+1), 1)
+	}
+
+	nodes, _ := r.GetNodes("key1", 5)
+	node, err := r.GetNodeExcluding("key1", nil)
+	if err != nil || node != nodes[0] {
+		t.Error("no exclusion: got", node, err, ", expected", nodes[0])
+	}
+	node, err = r.GetNodeExcluding("key1", map[string]bool{nodes[0]: true})
+	if err != nil || node != nodes[1] {
+		t.Error("owner excluded: got", node, err, ", expected", nodes[1])
+	}
+	node, err = r.GetNodeExcluding("key1", map[string]bool{nodes[0]: true, nodes[1]: true, nodes[3]: true})
+	if err != nil || node != nodes[2] {
+		t.Error("owner and backup excluded: got", node, err, ", expected", nodes[2])
+	}
+
+	all := make(map[string]bool)
+	for _, n := range nodes {
+		all[n] = true
+	}
+	if _, err = r.GetNodeExcluding("key1", all); err == nil {
+		t.Error("expected error when every node is excluded")
+	}
+	checkEqual(r.NodeCount(), 5, t)
+}
+
+func TestHashRing_GetNodeBounded(t *testing.T) {
+	r := InitHashRing()
+	if _, err := r.GetNodeBounded("key1", nil, 1.25); err == nil {
+		t.Error("expected error on empty ring")
+	}
+	for i := 0; i < 3; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i+1), 1)
+	}
+
+	primary, _ := r.GetNode("key1")
+	node, err := r.GetNodeBounded("key1", map[string]int64{}, 1.25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node != primary {
+		t.Error("unloaded ring: got", node, ", expected", primary)
+	}
+
+	// the primary is saturated, the key spills to the next node clockwise
+	nodes, _ := r.GetNodes("key1", 3)
+	load := map[string]int64{nodes[0]: 10, nodes[1]: 1, nodes[2]: 1}
+	node, err = r.GetNodeBounded("key1", load, 1.25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node != nodes[1] {
+		t.Error("saturated primary: got", node, ", expected", nodes[1])
+	}
+
+	load = map[string]int64{nodes[0]: 10, nodes[1]: 10, nodes[2]: 1}
+	node, _ = r.GetNodeBounded("key1", load, 1.25)
+	if node != nodes[2] {
+		t.Error("saturated primary and backup: got", node, ", expected", nodes[2])
+	}
+
+	if _, err = r.GetNodeBounded("key1", load, 0.1); err == nil {
+		t.Error("expected error when every node is over capacity")
+	}
+}
+
+// getNodesLinear: the original GetNodes, deduplicating by a linear scan
+func getNodesLinear(r *HashRing, name string, n int) (nodes []string) {
+	if len(r.members) < n {
+		n = len(r.members)
+	}
+	hasNode := func(node string) bool {
+		for _, m := range nodes {
+			if m == node {
+				return true
+			}
+		}
+		return false
+	}
+
+	i := r.loadSnapshot().search(r.generateHash(name))
+	nodes = append(nodes, r.ring[r.sortedRing[i]])
+	if len(nodes) == n {
+		return
+	}
+	start := i
+	for i = start + 1; i != start; i++ {
+		if i >= len(r.sortedRing) {
+			i = 0
+		}
+		elem := r.ring[r.sortedRing[i]]
+		if !hasNode(elem) {
+			nodes = append(nodes, elem)
+		}
+		if len(nodes) == n {
+			break
+		}
+	}
+	return
+}
+
+func TestGenerateKey_Injective(t *testing.T) {
+	keys := make(map[string]string)
+	for _, ip := range []string{"a", "a#1", "a#", "a#1#", "#1", "1", "a#10"} {
+		for i := 0; i < 20; i++ {
+			key := generateKey(ip, i)
+			if other, ok := keys[key]; ok {
+				t.Error("key", key, "of", ip, "already generated for", other)
+			}
+			keys[key] = ip
+		}
+	}
+
+	r := NewHashRing(WithVirtualCubes(4))
+	r.AddNode("a", 1)
+	r.AddNode("a#1", 1)
+	checkEqual(countCubes(r, "a"), 4, t)
+	checkEqual(countCubes(r, "a#1"), 4, t)
+}
+
+func TestHashRing_GetNodesFewMembers(t *testing.T) {
+	getNodes := func(r *HashRing, n int) (nodes []string) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 1000; i++ {
+				nodes, _ = r.GetNodes("key"+strconv.Itoa(i), n)
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("GetNodes does not terminate")
+		}
+		return
+	}
+
+	for _, cubes := range []int{1, DefaultVirtualCubes} {
+		r := NewHashRing(WithVirtualCubes(cubes))
+		r.AddNode("192.168.1.1", 1)
+		nodes := getNodes(r, 3)
+		if len(nodes) != 1 || nodes[0] != "192.168.1.1" {
+			t.Error("cubes", cubes, "single node got", nodes)
+		}
+
+		r.AddNode("192.168.1.2", 1)
+		nodes = getNodes(r, 3)
+		if len(nodes) != 2 || nodes[0] == nodes[1] {
+			t.Error("cubes", cubes, "two nodes got", nodes)
+		}
+	}
+}
+
+func TestHashRing_GetNodesLimited(t *testing.T) {
+	// 100 cubes of a come first clockwise from key, then b and c
+	points := map[string]uint32{"key": 0, "b#0": 1000, "c#0": 2000}
+	for i := 0; i < 100; i++ {
+		points["a#"+strconv.Itoa(i)] = uint32(i + 1)
+	}
+	r := NewHashRing(WithHashFunc(tableHash(points)), WithVirtualCubes(1))
+	r.AddNodes(map[string]int{"a": 100, "b": 1, "c": 1})
+
+	for _, c := range []struct {
+		maxProbe int
+		nodes    string
+		full     bool
+	}{
+		{50, "[a]", false},
+		{101, "[a b]", false},
+		{102, "[a b c]", true},
+		{0, "[a b c]", true},
+	} {
+		nodes, full, err := r.GetNodesLimited("key", 3, c.maxProbe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(nodes) != c.nodes || full != c.full {
+			t.Error("maxProbe", c.maxProbe, "got", nodes, full, ", expected", c.nodes, c.full)
+		}
+	}
+
+	nodes, full, _ := r.GetNodesLimited("key", 5, 0)
+	if len(nodes) != 3 || !full {
+		t.Error("n above the member count got", nodes, full)
+	}
+	if _, _, err := NewHashRing().GetNodesLimited("key", 3, 10); err == nil {
+		t.Error("expected an error on an empty ring")
+	}
+}
+
+func TestHashRing_GetWeightedNodes(t *testing.T) {
+	r := NewHashRing()
+	if _, err := r.GetWeightedNodes("key", 2); err == nil {
+		t.Error("expected an error on an empty ring")
+	}
+	r.AddNodes(map[string]int{"192.168.1.1": 1, "192.168.1.2": 1, "192.168.1.3": 1, "192.168.1.4": 4})
+
+	weighted := make(map[string]int)
+	plain := make(map[string]int)
+	for i := 0; i < 20000; i++ {
+		key := "key" + strconv.Itoa(i)
+		nodes, _ := r.GetWeightedNodes(key, 2)
+		if len(nodes) != 2 || nodes[0] == nodes[1] {
+			t.Fatal("key", key, "got", nodes)
+		}
+		for _, node := range nodes {
+			weighted[node]++
+		}
+		nodes, _ = r.GetNodes(key, 2)
+		for _, node := range nodes {
+			plain[node]++
+		}
+	}
+	heavy, light := weighted["192.168.1.4"], weighted["192.168.1.1"]
+	if heavy < 2*light {
+		t.Error("heavy node in", heavy, "replica sets, light node in", light)
+	}
+	if heavy <= plain["192.168.1.4"] {
+		t.Error("heavy node in", heavy, "weighted replica sets, in", plain["192.168.1.4"], "with GetNodes")
+	}
+
+	// every node is returned when n covers the ring
+	nodes, _ := r.GetWeightedNodes("key1", 10)
+	checkEqual(len(nodes), 4, t)
+	again, _ := r.GetWeightedNodes("key1", 10)
+	if fmt.Sprint(nodes) != fmt.Sprint(again) {
+		t.Error("got", nodes, "then", again)
+	}
+}
+
+func TestHashRing_GetNodesSameAsLinear(t *testing.T) {
+	r := benchmarkRing(200)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		for _, n := range []int{1, 3, 50, 200, 300} {
+			nodes, _ := r.GetNodes(key, n)
+			expected := getNodesLinear(r, key, n)
+			if fmt.Sprint(nodes) != fmt.Sprint(expected) {
+				t.Fatal(key, n, "got", nodes, ", expected", expected)
+			}
+		}
+	}
+}
+
+func TestHashRing_GetNodesWrap(t *testing.T) {
+	for _, inclusive := range []bool{false, true} {
+		r := NewHashRing(WithInclusiveSearch(inclusive), WithVirtualCubes(2), WithHashFunc(tableHash(map[string]uint32{
+			"a#0": 1000, "a#1": 3500,
+			"b#0": 2000, "b#1": 2500,
+			"c#0": 3000, "c#1": 4000,
+			"past": 5000, "max": 1<<32 - 1, "last": 4000,
+		})))
+		r.AddNodes(map[string]int{"a": 1, "b": 1, "c": 1})
+
+		// every key wraps to the first cube, owned by a
+		keys := []string{"past", "max"}
+		if !inclusive {
+			keys = append(keys, "last")
+		}
+		for _, key := range keys {
+			checkEqual(r.loadSnapshot().search(r.generateHash(key)), 0, t)
+			for n := 1; n <= 4; n++ {
+				nodes, _ := r.GetNodes(key, n)
+				expected := []string{"a", "b", "c"}[:min(n, 3)]
+				if fmt.Sprint(nodes) != fmt.Sprint(expected) {
+					t.Error(key, n, "inclusive", inclusive, "got", nodes, ", expected", expected)
+				}
+			}
+		}
+	}
+
+	// a node met only after wrapping is still found
+	r := NewHashRing(WithVirtualCubes(1), WithHashFunc(tableHash(map[string]uint32{
+		"a#0": 1000, "b#0": 2000, "c#0": 3000, "key": 1500,
+	})))
+	r.AddNodes(map[string]int{"a": 1, "b": 1, "c": 1})
+	if nodes, _ := r.GetNodes("key", 3); fmt.Sprint(nodes) != "[b c a]" {
+		t.Error("got", nodes, ", expected [b c a]")
+	}
+}
+
+func TestHashRing_GetNodesWrapSameAsLinear(t *testing.T) {
+	r := benchmarkRing(50)
+	last := r.sortedRing[len(r.sortedRing)-1]
+	found := 0
+	for i := 0; found < 20; i++ {
+		key := "key" + strconv.Itoa(i)
+		if r.generateHash(key) < last {
+			continue
+		}
+		found++
+		for _, n := range []int{1, 2, 10, 50, 60} {
+			nodes, _ := r.GetNodes(key, n)
+			expected := getNodesLinear(r, key, n)
+			if fmt.Sprint(nodes) != fmt.Sprint(expected) {
+				t.Fatal(key, n, "got", nodes, ", expected", expected)
+			}
+		}
+	}
+}
+
+func BenchmarkHashRing_GetNodesAll(b *testing.B) {
+	r := benchmarkRing(1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.GetNodes("key"+strconv.Itoa(i), 1000)
+	}
+}
+
+func BenchmarkHashRing_GetNodesAllLinear(b *testing.B) {
+	r := benchmarkRing(1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		getNodesLinear(r, "key"+strconv.Itoa(i), 1000)
+	}
+}
+
+func TestHashRing_GetNodesAllocs(t *testing.T) {
+	small, large := benchmarkRing(10), benchmarkRing(1000)
+	allocs := func(r *HashRing) float64 {
+		return testing.AllocsPerRun(100, func() {
+			r.GetNodes("key1", 3)
+		})
+	}
+	// the member count is read without copying the members
+	if a, b := allocs(small), allocs(large); a != b {
+		t.Error("GetNodes allocations grow with the member count:", a, "vs", b)
+	}
+}
+
+func TestHashRing_GetNodeBatch(t *testing.T) {
+	r := NewHashRing()
+	if _, err := r.GetNodeBatch([]string{"key1"}); !errors.Is(err, ErrEmptyRing) {
+		t.Error("empty ring got", err)
+	}
+	r = benchmarkRing(100)
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = "key" + strconv.Itoa(i)
+	}
+	nodes, err := r.GetNodeBatch(names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(len(nodes), len(names), t)
+	for i, name := range names {
+		if node, _ := r.GetNode(name); nodes[i] != node {
+			t.Fatal(name, "got", nodes[i], ", expected", node)
+		}
+	}
+}
+
+func BenchmarkHashRing_GetNodeBatch(b *testing.B) {
+	r := benchmarkRing(1000)
+	names := make([]string, 256)
+	for i := range names {
+		names[i] = "key" + strconv.Itoa(i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.GetNodeBatch(names)
+	}
+}
+
+func BenchmarkHashRing_GetNodeLoop(b *testing.B) {
+	r := benchmarkRing(1000)
+	names := make([]string, 256)
+	for i := range names {
+		names[i] = "key" + strconv.Itoa(i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, name := range names {
+			r.GetNode(name)
+		}
+	}
+}
+
+func TestHashRing_GetNodeParallel(t *testing.T) {
+	names := make([]string, 10007)
+	for i := range names {
+		names[i] = "key" + strconv.Itoa(i)
+	}
+	for _, node := range NewHashRing().GetNodeParallel(names[:3], 2) {
+		if node != "" {
+			t.Error("empty ring got", node)
+		}
+	}
+
+	r := benchmarkRing(100)
+	serial, _ := r.GetNodeBatch(names)
+	for _, workers := range []int{0, 1, 3, 8, 20000} {
+		nodes := r.GetNodeParallel(names, workers)
+		if fmt.Sprint(nodes) != fmt.Sprint(serial) {
+			t.Error("workers", workers, "results differ from serial ones")
+		}
+	}
+	checkEqual(len(r.GetNodeParallel(nil, 4)), 0, t)
+}
+
+func BenchmarkHashRing_GetNodeParallelWorkers(b *testing.B) {
+	r := benchmarkRing(1000)
+	names := make([]string, 100000)
+	for i := range names {
+		names[i] = "key" + strconv.Itoa(i)
+	}
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(strconv.Itoa(workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				r.GetNodeParallel(names, workers)
+			}
+		})
+	}
+}
+
+func TestHashRing_GetNodeBytes(t *testing.T) {
+	r := benchmarkRing(100)
+	for i := 0; i < 1000; i++ {
+		key := "key" + strconv.Itoa(i)
+		node, _ := r.GetNode(key)
+		if got, _ := r.GetNodeBytes([]byte(key)); got != node {
+			t.Fatal("key", key, "got", got, ", expected", node)
+		}
+	}
+
+	name := []byte("key1")
+	allocs := testing.AllocsPerRun(100, func() {
+		r.GetNodeBytes(name)
+	})
+	if allocs != 0 {
+		t.Error("GetNodeBytes allocs got", allocs, ", expected 0")
+	}
+}
+
+func BenchmarkHashRing_GetNodeBytes(b *testing.B) {
+	r := benchmarkRing(1000)
+	name := []byte("key1")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.GetNodeBytes(name)
+	}
+}
+
+func BenchmarkHashRing_GetNodes(b *testing.B) {
+	r := benchmarkRing(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.GetNodes("key"+strconv.Itoa(i), 3)
+	}
+}
+
+func TestHashRing_GetNodesConcurrent(t *testing.T) {
+	r := InitHashRing()
+	r.AddNode("192.168.1.1", 1)
+
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(2)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					r.AddNode(fmt.Sprintf("10.0.%d.%d", g, i), 1)
+				}
+			}(g)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 2000; i++ {
+					if _, err := r.GetNodes(fmt.Sprintf("key%d", i), 3); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("concurrent AddNode and GetNodes deadlocked")
+	}
+}
+
+func TestHashRing_ConcurrentReadWrite(t *testing.T) {
+	r := InitHashRing()
+	for i := 0; i < 5; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i+1), 1)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("key%d", i)
+				if _, err := r.GetNode(key); err != nil {
+					t.Error(err)
+					return
+				}
+				if nodes, err := r.GetNodes(key, 3); err != nil || len(nodes) != 3 {
+					t.Error("got", nodes, err)
+					return
+				}
+				next := r.Walk(key)
+				for _, ok := next(); ok; _, ok = next() {
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		r.AddNode("10.0.0."+strconv.Itoa(i), 1)
+		r.UpdateWeight("192.168.1.1", i%3+1)
+		r.RemoveNode("10.0.0." + strconv.Itoa(i))
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func BenchmarkHashRing_GetNodesInto(b *testing.B) {
+	r := benchmarkRing(1000)
+	dst := make([]string, 0, 3)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst, _ = r.GetNodesInto("key"+strconv.Itoa(i), 3, dst)
+	}
+}
+
+func BenchmarkHashRing_GetNodeParallel(b *testing.B) {
+	r := benchmarkRing(100)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			r.GetNode("key" + strconv.Itoa(i))
+		}
+	})
 }
 
 func TestHashRing_Dispersion(t *testing.T) {
@@ -0,0 +1,196 @@
+package consistentHash
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Dump writes the members with their weights, then each cube of the sorted
+// ring with its node in ascending order. At most limit cubes are written,
+// a non-positive limit writes them all.
+func (r *HashRing) Dump(w io.Writer, limit int) error {
+	if r == nil {
+		return ErrNotInitialized
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	members := make([]string, 0, len(r.members))
+	for ip := range r.members {
+		members = append(members, ip)
+	}
+	sort.Strings(members)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "members: %d, cubes per weight: %d, ring size: %d\n",
+		len(members), r.numberOfCubes, len(r.sortedRing))
+	for _, ip := range members {
+		fmt.Fprintf(bw, "%s weight %d\n", ip, r.weights[ip])
+	}
+
+	count := len(r.sortedRing)
+	if limit > 0 && limit < count {
+		count = limit
+	}
+	for _, hash := range r.sortedRing[:count] {
+		fmt.Fprintf(bw, "%#08x %s\n", hash, r.ring[hash])
+	}
+	if count < len(r.sortedRing) {
+		fmt.Fprintf(bw, "... %d more cubes\n", len(r.sortedRing)-count)
+	}
+	return bw.Flush()
+}
+
+// Entry is a cube of the ring: its hash and the real node owning it
+type Entry struct {
+	Hash uint32
+	Node string
+}
+
+// Entries returns a copy of every cube of the ring in ascending hash order
+func (r *HashRing) Entries() []Entry {
+	s := r.loadSnapshot()
+	entries := make([]Entry, len(s.sortedRing))
+	for i, hash := range s.sortedRing {
+		entries[i] = Entry{Hash: hash, Node: s.nodes[i]}
+	}
+	return entries
+}
+
+// GetPoints returns the next k cubes clockwise from where name hashes to,
+// starting at the cube owning name, without removing repeated nodes.
+// k is capped to the number of cubes, an empty ring has no points.
+func (r *HashRing) GetPoints(name string, k int) []Entry {
+	s := r.loadSnapshot()
+	if k > len(s.sortedRing) {
+		k = len(s.sortedRing)
+	}
+	if k <= 0 {
+		return nil
+	}
+	points := make([]Entry, k)
+	start := s.search(s.hash(name))
+	for i := range points {
+		j := (start + i) % len(s.sortedRing)
+		points[i] = Entry{Hash: s.sortedRing[j], Node: s.nodes[j]}
+	}
+	return points
+}
+
+// Verify checks the invariants of the ring: sortedRing holds the hashes of
+// ring in strictly ascending order, every cube belongs to a member and
+// lookups see the current cubes. It returns an error on the first broken one.
+func (r *HashRing) Verify() error {
+	if r == nil {
+		return nil
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	if len(r.sortedRing) != len(r.ring) {
+		return fmt.Errorf("sortedRing has %d cubes, ring has %d", len(r.sortedRing), len(r.ring))
+	}
+	for i, hash := range r.sortedRing {
+		if i > 0 && r.sortedRing[i-1] >= hash {
+			return fmt.Errorf("sortedRing is not sorted at %d: %#08x after %#08x", i, hash, r.sortedRing[i-1])
+		}
+		if _, ok := r.ring[hash]; !ok {
+			return fmt.Errorf("cube %#08x of sortedRing is not in ring", hash)
+		}
+	}
+	for hash, node := range r.ring {
+		if !r.members[node] {
+			return fmt.Errorf("cube %#08x belongs to %s which is not a member", hash, node)
+		}
+	}
+	s := r.loadSnapshot()
+	enabled := make(uintArray, 0, len(r.sortedRing))
+	for _, hash := range r.sortedRing {
+		if !r.disabled[hash] {
+			enabled = append(enabled, hash)
+		}
+	}
+	if len(s.sortedRing) != len(enabled) || len(s.nodes) != len(enabled) {
+		return fmt.Errorf("published snapshot has %d cubes, ring has %d enabled", len(s.sortedRing), len(enabled))
+	}
+	for i, hash := range enabled {
+		if s.sortedRing[i] != hash || s.nodes[i] != r.ring[hash] {
+			return fmt.Errorf("published snapshot differs from ring at cube %#08x", hash)
+		}
+	}
+	return nil
+}
+
+// RingTesting gives fault injection tools for tests of code using a ring,
+// they are not meant for production use
+type RingTesting struct {
+	r *HashRing
+}
+
+// Testing returns the fault injection tools of the ring
+func (r *HashRing) Testing() RingTesting {
+	return RingTesting{r: r}
+}
+
+// DisablePoint hides the cube at hash from lookups as if it went dark:
+// the keys it owns go to the next cube clockwise, the node keeps its other
+// cubes. It stays disabled until EnablePoint, even if its node is removed
+// and another node takes the hash later. Return false if no cube is at hash.
+func (t RingTesting) DisablePoint(hash uint32) bool {
+	return t.r.disablePoint(hash)
+}
+
+// EnablePoint makes a cube disabled by DisablePoint visible to lookups again
+func (t RingTesting) EnablePoint(hash uint32) {
+	t.r.enablePoint(hash)
+}
+
+// disablePoint: see RingTesting.DisablePoint
+func (r *HashRing) disablePoint(hash uint32) bool {
+	if r == nil {
+		return false
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.ring[hash]; !ok {
+		return false
+	}
+	if r.disabled == nil {
+		r.disabled = make(map[uint32]bool)
+	}
+	r.disabled[hash] = true
+	r.publish()
+	return true
+}
+
+// enablePoint: see RingTesting.EnablePoint
+func (r *HashRing) enablePoint(hash uint32) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.disabled[hash] {
+		return
+	}
+	delete(r.disabled, hash)
+	r.publish()
+}
+
+// String returns the sorted members and the cube number of the ring
+func (r *HashRing) String() string {
+	if r == nil {
+		return "<nil>"
+	}
+	r.RLock()
+	cubes := r.numberOfCubes
+	r.RUnlock()
+
+	return fmt.Sprintf("HashRing{members: [%s], cubes: %d}",
+		strings.Join(r.SortedMembers(), " "), cubes)
+}
@@ -0,0 +1,174 @@
+package consistentHash
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHashRing_Dump(t *testing.T) {
+	r := NewHashRing(WithVirtualCubes(4))
+	r.AddNode("192.168.1.1", 1)
+	r.AddNode("192.168.1.2", 2)
+
+	var buf bytes.Buffer
+	if err := r.Dump(&buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, s := range []string{"192.168.1.1 weight 1", "192.168.1.2 weight 2", "ring size: 12"} {
+		if !strings.Contains(out, s) {
+			t.Error("dump does not contain", s, ":\n", out)
+		}
+	}
+	checkEqual(strings.Count(out, "\n"), 1+2+12, t)
+
+	buf.Reset()
+	r.Dump(&buf, 5)
+	out = buf.String()
+	checkEqual(strings.Count(out, "\n"), 1+2+5+1, t)
+	if !strings.Contains(out, "... 7 more cubes") {
+		t.Error("limited dump does not report the omitted cubes:\n", out)
+	}
+}
+
+func TestHashRing_Entries(t *testing.T) {
+	r := NewHashRing(WithVirtualCubes(4))
+	checkEqual(len(r.Entries()), 0, t)
+
+	r.AddNode("192.168.1.1", 1)
+	r.AddNode("192.168.1.2", 2)
+	entries := r.Entries()
+	checkEqual(len(entries), len(r.sortedRing), t)
+	for i, e := range entries {
+		if i > 0 && entries[i-1].Hash >= e.Hash {
+			t.Fatal("entries are not sorted at", i)
+		}
+		if r.ring[e.Hash] != e.Node {
+			t.Error("entry", e.Hash, "got", e.Node, ", expected", r.ring[e.Hash])
+		}
+	}
+
+	entries[0].Node = "changed"
+	if r.Entries()[0].Node == "changed" {
+		t.Error("Entries does not return a copy")
+	}
+}
+
+func TestHashRing_GetPoints(t *testing.T) {
+	r := NewHashRing(WithHashFunc(tableHash(map[string]uint32{
+		"a#0": 100,
+		"a#1": 200,
+		"b#0": 300,
+		"a#2": 400,
+		"key": 250,
+	})), WithVirtualCubes(1))
+	if r.GetPoints("key", 3) != nil {
+		t.Error("empty ring got points")
+	}
+	r.AddNode("a", 3)
+	r.AddNode("b", 1)
+
+	expected := "[{300 b} {400 a} {100 a} {200 a}]"
+	if got := fmt.Sprint(r.GetPoints("key", 4)); got != expected {
+		t.Error("got", got, ", expected", expected)
+	}
+	if got := fmt.Sprint(r.GetPoints("key", 10)); got != expected {
+		t.Error("k above the ring size got", got)
+	}
+	if got := fmt.Sprint(r.GetPoints("key", 2)); got != "[{300 b} {400 a}]" {
+		t.Error("got", got)
+	}
+	checkEqual(len(r.GetPoints("key", 0)), 0, t)
+}
+
+func TestHashRing_String(t *testing.T) {
+	r := NewHashRing(WithVirtualCubes(4))
+	r.AddNode("192.168.1.2", 1)
+	r.AddNode("192.168.1.1", 1)
+	expected := "HashRing{members: [192.168.1.1 192.168.1.2], cubes: 4}"
+	if s := fmt.Sprintf("%v", r); s != expected {
+		t.Error("got", s, ", expected", expected)
+	}
+}
+
+func TestHashRing_Verify(t *testing.T) {
+	r := NewHashRing(WithHashFunc(func(data []byte) uint32 {
+		return crc32.ChecksumIEEE(data) % 1000
+	}))
+	if err := r.Verify(); err != nil {
+		t.Error("empty ring:", err)
+	}
+	for i := 1; i <= 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i), i%3+1)
+	}
+	r.UpdateWeight("192.168.1.1", 5)
+	r.RemoveNode("192.168.1.2")
+	r.AddNodes(map[string]int{"192.168.1.2": 2, "192.168.1.3": 1})
+	r.RemoveNodes([]string{"192.168.1.4", "192.168.1.5"})
+	if err := r.Verify(); err != nil {
+		t.Fatal("after changes:", err)
+	}
+
+	// a cube left behind by a removed node
+	c := r.Clone()
+	c.ring[c.sortedRing[0]] = "192.168.1.4"
+	if err := c.Verify(); err == nil {
+		t.Error("expected an error for a cube of a removed node")
+	}
+
+	c = r.Clone()
+	c.sortedRing[0], c.sortedRing[1] = c.sortedRing[1], c.sortedRing[0]
+	if err := c.Verify(); err == nil {
+		t.Error("expected an error for an unsorted ring")
+	}
+
+	c = r.Clone()
+	c.sortedRing = c.sortedRing[1:]
+	if err := c.Verify(); err == nil {
+		t.Error("expected an error for a missing cube")
+	}
+}
+
+func TestHashRing_DisablePoint(t *testing.T) {
+	r := NewHashRing(WithVirtualCubes(1), WithHashFunc(tableHash(map[string]uint32{
+		"a#0": 1000, "b#0": 2000, "c#0": 3000,
+		"key": 1500, "other": 2500,
+	})))
+	r.AddNodes(map[string]int{"a": 1, "b": 1, "c": 1})
+	if node, _ := r.GetNode("key"); node != "b" {
+		t.Fatal("got", node, ", expected b")
+	}
+
+	if r.Testing().DisablePoint(1234) {
+		t.Error("disabled a point without cube")
+	}
+	if !r.Testing().DisablePoint(2000) {
+		t.Fatal("could not disable the cube of b")
+	}
+	// the keys of b#0 go to the next cube, the other keys stay
+	if node, _ := r.GetNode("key"); node != "c" {
+		t.Error("disabled: got", node, ", expected c")
+	}
+	if node, _ := r.GetNode("other"); node != "c" {
+		t.Error("disabled: got", node, ", expected c")
+	}
+	if nodes, _ := r.GetNodes("key", 3); fmt.Sprint(nodes) != "[c a]" {
+		t.Error("disabled: got", nodes, ", expected [c a]")
+	}
+	checkEqual(r.NodeCount(), 3, t)
+	if err := r.Verify(); err != nil {
+		t.Error(err)
+	}
+
+	r.Testing().EnablePoint(2000)
+	if node, _ := r.GetNode("key"); node != "b" {
+		t.Error("enabled: got", node, ", expected b")
+	}
+	if err := r.Verify(); err != nil {
+		t.Error(err)
+	}
+}
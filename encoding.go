@@ -0,0 +1,408 @@
+package consistentHash
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// ringTopology: logical topology of a ring, the virtual cubes are derived
+// from it and rebuilt when it is restored. NodeCubes only holds the nodes
+// whose cubes per weight differ from Cubes, Meta the nodes with metadata.
+type ringTopology struct {
+	Cubes     int                          `json:"cubes"`
+	Members   map[string]bool              `json:"members"`
+	Weights   map[string]int               `json:"weights"`
+	NodeCubes map[string]int               `json:"nodeCubes,omitempty"`
+	Meta      map[string]map[string]string `json:"meta,omitempty"`
+	Scale     int                          `json:"weightScale,omitempty"`
+}
+
+// topology: copy the logical topology, the caller holds the read lock
+func (r *HashRing) topology() ringTopology {
+	t := ringTopology{
+		Cubes:   r.numberOfCubes,
+		Members: make(map[string]bool, len(r.members)),
+		Weights: make(map[string]int, len(r.weights)),
+		Scale:   r.weightScale,
+	}
+	for k, v := range r.members {
+		t.Members[k] = v
+	}
+	for k, v := range r.weights {
+		t.Weights[k] = v
+	}
+	for k, v := range r.cubes {
+		if v != r.numberOfCubes {
+			if t.NodeCubes == nil {
+				t.NodeCubes = make(map[string]int)
+			}
+			t.NodeCubes[k] = v
+		}
+	}
+	for k, v := range r.meta {
+		if t.Meta == nil {
+			t.Meta = make(map[string]map[string]string)
+		}
+		t.Meta[k] = copyMeta(v)
+	}
+	return t
+}
+
+// maxDecodedCubes bounds the virtual cubes of a decoded ring, so that a
+// corrupt input cannot make the decoder allocate without limit
+const maxDecodedCubes = 1 << 24
+
+// checkTopology: reject topologies with an invalid weight scale, weights
+// above the cap of the ring or more than maxDecodedCubes cubes, the caller
+// holds the lock
+func (r *HashRing) checkTopology(t ringTopology) error {
+	if t.Scale < 0 || t.Scale > maxWeightScale {
+		return fmt.Errorf("invalid weight scale %d", t.Scale)
+	}
+	numberOfCubes := t.Cubes
+	if numberOfCubes <= 0 {
+		numberOfCubes = DefaultVirtualCubes
+	}
+	total := 0
+	for ip, weight := range t.Weights {
+		weight = r.normalizeWeight(weight)
+		if err := r.checkWeight(ip, weight, max(t.Scale, 1)); err != nil {
+			return err
+		}
+		cubes := t.NodeCubes[ip]
+		if cubes <= 0 {
+			cubes = numberOfCubes
+		}
+		if err := checkCubes(ip, cubes, weight); err != nil {
+			return err
+		}
+		if cubes*weight > maxDecodedCubes-total {
+			return fmt.Errorf("decoded ring exceeds %d cubes", maxDecodedCubes)
+		}
+		total += cubes * weight
+	}
+	return nil
+}
+
+// restore: replace the ring content by replaying the nodes of t,
+// the caller holds the lock
+func (r *HashRing) restore(t ringTopology) {
+	r.ring = make(map[uint32]string)
+	r.collisions = nil
+	r.disabled = nil
+	r.members = make(map[string]bool, len(t.Weights))
+	r.weights = make(map[string]int, len(t.Weights))
+	r.cubes = make(map[string]int, len(t.Weights))
+	r.meta = make(map[string]map[string]string, len(t.Meta))
+	r.numberOfCubes = t.Cubes
+	if r.numberOfCubes <= 0 {
+		r.numberOfCubes = DefaultVirtualCubes
+	}
+	r.weightScale = t.Scale
+
+	for ip, weight := range t.Weights {
+		weight = r.normalizeWeight(weight)
+		cubes := t.NodeCubes[ip]
+		if cubes <= 0 {
+			cubes = r.numberOfCubes
+		}
+		r.addCubes(ip, 0, cubes*weight)
+		member, ok := t.Members[ip]
+		r.members[ip] = member || !ok
+		r.weights[ip] = weight
+		r.cubes[ip] = cubes
+		if meta, ok := t.Meta[ip]; ok {
+			r.meta[ip] = copyMeta(meta)
+		}
+	}
+	r.updateSortedRing()
+	r.publish()
+}
+
+// Equal reports whether r and other have the same cube number, weight scale,
+// members, weights and cubes per node, i.e. place keys the same way given the same
+// hash function. The rings are read one after the other, each under its
+// own read lock, so concurrent a.Equal(b) and b.Equal(a) cannot deadlock.
+func (r *HashRing) Equal(other *HashRing) bool {
+	if r == other {
+		return true
+	}
+	if r == nil || other == nil {
+		return false
+	}
+	r.RLock()
+	t1 := r.topology()
+	r.RUnlock()
+	other.RLock()
+	t2 := other.topology()
+	other.RUnlock()
+
+	if t1.Cubes != t2.Cubes || max(t1.Scale, 1) != max(t2.Scale, 1) || len(t1.Weights) != len(t2.Weights) || len(t1.NodeCubes) != len(t2.NodeCubes) {
+		return false
+	}
+	for ip, weight := range t1.Weights {
+		if w, ok := t2.Weights[ip]; !ok || w != weight || t1.Members[ip] != t2.Members[ip] {
+			return false
+		}
+	}
+	for ip, cubes := range t1.NodeCubes {
+		if t2.NodeCubes[ip] != cubes {
+			return false
+		}
+	}
+	return true
+}
+
+// MarshalJSON encodes the cube number, members and weights of the ring
+func (r *HashRing) MarshalJSON() ([]byte, error) {
+	if r == nil {
+		return nil, ErrNotInitialized
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	return json.Marshal(r.topology())
+}
+
+// UnmarshalJSON rebuilds the ring from the output of MarshalJSON.
+// The hash function is not encoded, the receiver's one is kept.
+// Weights above the cap of the receiver are rejected and the ring is
+// left unchanged on error.
+func (r *HashRing) UnmarshalJSON(data []byte) error {
+	if r == nil {
+		return ErrNotInitialized
+	}
+	var t ringTopology
+	if err := json.Unmarshal(data, &t); err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.checkTopology(t); err != nil {
+		return err
+	}
+	r.restore(t)
+	return nil
+}
+
+// GobEncode encodes the cube number, members and weights of the ring
+func (r *HashRing) GobEncode() ([]byte, error) {
+	if r == nil {
+		return nil, ErrNotInitialized
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(r.topology()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GobDecode rebuilds the ring from the output of GobEncode.
+// The hash function is not encoded, the receiver's one is kept.
+// Weights above the cap of the receiver are rejected and the ring is
+// left unchanged on error.
+func (r *HashRing) GobDecode(data []byte) error {
+	if r == nil {
+		return ErrNotInitialized
+	}
+	var t ringTopology
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&t); err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.checkTopology(t); err != nil {
+		return err
+	}
+	r.restore(t)
+	return nil
+}
+
+// binaryVersion is the first byte of the binary encoding of a ring,
+// version 1 has no weight scale
+const binaryVersion = 2
+
+// maxBinaryID bounds the node ids read by ReadFrom
+const maxBinaryID = 1 << 16
+
+// WriteTo streams the cube number and the weight scale, then each node with
+// its weight and cubes per weight in a compact binary format read by
+// ReadFrom. The metadata of the nodes is not written. It implements
+// io.WriterTo.
+func (r *HashRing) WriteTo(w io.Writer) (int64, error) {
+	if r == nil {
+		return 0, ErrNotInitialized
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	ips := make([]string, 0, len(r.weights))
+	for ip := range r.weights {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	var buf [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) {
+		bw.Write(buf[:binary.PutUvarint(buf[:], v)])
+	}
+	bw.WriteByte(binaryVersion)
+	putUvarint(uint64(r.numberOfCubes))
+	putUvarint(uint64(r.weightScale))
+	putUvarint(uint64(len(ips)))
+	for _, ip := range ips {
+		putUvarint(uint64(len(ip)))
+		bw.WriteString(ip)
+		putUvarint(uint64(r.weights[ip]))
+		putUvarint(uint64(r.cubes[ip]))
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ReadFrom replaces the content of the ring by the output of WriteTo and
+// rebuilds the ring. The hash function is not encoded, the receiver's one
+// is kept. The ring is left unchanged on error. It implements io.ReaderFrom.
+func (r *HashRing) ReadFrom(rd io.Reader) (int64, error) {
+	if r == nil {
+		return 0, ErrNotInitialized
+	}
+	cr := &countReader{r: bufio.NewReader(rd)}
+	t, err := readTopology(cr)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return cr.n, err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.checkTopology(t); err != nil {
+		return cr.n, err
+	}
+	r.restore(t)
+	return cr.n, nil
+}
+
+// readTopology: decode the output of WriteTo
+func readTopology(cr *countReader) (t ringTopology, err error) {
+	version, err := cr.ReadByte()
+	if err != nil {
+		return t, err
+	}
+	if version != 1 && version != binaryVersion {
+		return t, fmt.Errorf("unknown binary ring version %d", version)
+	}
+	readInt := func() (int, error) {
+		v, err := binary.ReadUvarint(cr)
+		if err == nil && v > math.MaxInt32 {
+			err = errors.New("binary ring value out of range")
+		}
+		return int(v), err
+	}
+
+	if t.Cubes, err = readInt(); err != nil {
+		return t, err
+	}
+	if version > 1 {
+		if t.Scale, err = readInt(); err != nil {
+			return t, err
+		}
+	}
+	count, err := readInt()
+	if err != nil {
+		return t, err
+	}
+	t.Members = make(map[string]bool)
+	t.Weights = make(map[string]int)
+	t.NodeCubes = make(map[string]int)
+	total := 0
+	for i := 0; i < count; i++ {
+		size, err := readInt()
+		if err != nil {
+			return t, err
+		}
+		if size == 0 || size > maxBinaryID {
+			return t, fmt.Errorf("invalid node id length %d", size)
+		}
+		id := make([]byte, size)
+		if _, err = io.ReadFull(cr, id); err != nil {
+			return t, err
+		}
+		ip := string(id)
+		if _, ok := t.Weights[ip]; ok {
+			return t, fmt.Errorf("duplicate node %s", ip)
+		}
+		if t.Weights[ip], err = readInt(); err != nil {
+			return t, err
+		}
+		if t.NodeCubes[ip], err = readInt(); err != nil {
+			return t, err
+		}
+		cubes := t.NodeCubes[ip]
+		if cubes == 0 {
+			cubes = t.Cubes
+		}
+		weight := max(t.Weights[ip], 1)
+		if err = checkCubes(ip, cubes, weight); err != nil {
+			return t, err
+		}
+		if cubes*weight > maxDecodedCubes-total {
+			return t, fmt.Errorf("binary ring exceeds %d cubes", maxDecodedCubes)
+		}
+		total += cubes * weight
+		t.Members[ip] = true
+	}
+	return t, nil
+}
+
+// countWriter counts the bytes written to w
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countReader counts the bytes read from r
+type countReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
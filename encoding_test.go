@@ -0,0 +1,301 @@
+package consistentHash
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func checkSamePlacement(a, b *HashRing, t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		n1, err1 := a.GetNode(key)
+		n2, err2 := b.GetNode(key)
+		if n1 != n2 || (err1 == nil) != (err2 == nil) {
+			t.Error(key, "placed on", n1, "and", n2)
+			return
+		}
+	}
+}
+
+func TestHashRing_JSON(t *testing.T) {
+	r := NewHashRing()
+	r.numberOfCubes = 64
+	for i := 0; i < 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i+1), i+1)
+	}
+	r.AddNodeWithCubes("192.168.1.11", 2, 200)
+	r.AddNodeMeta("192.168.1.12", 1, map[string]string{"zone": "z1"})
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded HashRing
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(decoded.numberOfCubes, 64, t)
+	checkEqual(len(decoded.Members()), 12, t)
+	checkEqual(decoded.cubes["192.168.1.11"], 200, t)
+	if zone := decoded.Meta("192.168.1.12")["zone"]; zone != "z1" {
+		t.Error("zone got", zone, ", expected z1")
+	}
+	checkEqual(len(decoded.sortedRing), len(r.sortedRing), t)
+	for ip, weight := range r.weights {
+		checkEqual(decoded.weights[ip], weight, t)
+	}
+	checkSamePlacement(r, &decoded, t)
+}
+
+func TestHashRing_JSONEmpty(t *testing.T) {
+	data, err := json.Marshal(NewHashRing())
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := NewHashRing()
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(len(decoded.Members()), 0, t)
+	if _, err := decoded.GetNode("key1"); err == nil {
+		t.Error("expected error on empty ring")
+	}
+
+	if err := json.Unmarshal([]byte(`{"weights":{"192.168.1.1":1}}`), decoded); err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(decoded.numberOfCubes, DefaultVirtualCubes, t)
+	checkEqual(len(decoded.ring), DefaultVirtualCubes, t)
+}
+
+func TestHashRing_Gob(t *testing.T) {
+	r := NewHashRing()
+	for i := 0; i < 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i+1), i+1)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(r); err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(HashRing)
+	if err := gob.NewDecoder(&buf).Decode(decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	m1, m2 := r.Members(), decoded.Members()
+	sort.Strings(m1)
+	sort.Strings(m2)
+	if fmt.Sprint(m1) != fmt.Sprint(m2) {
+		t.Error("members", m2, ", expected", m1)
+	}
+	checkSamePlacement(r, decoded, t)
+	decoded.AddNode("192.168.1.11", 1)
+	checkEqual(decoded.NodeCount(), 11, t)
+}
+
+func TestHashRing_GobTruncated(t *testing.T) {
+	r := NewHashRing()
+	r.AddNode("192.168.1.1", 1)
+	data, err := r.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, 1, len(data) / 2, len(data) - 1} {
+		if err := new(HashRing).GobDecode(data[:n]); err == nil {
+			t.Error("expected error decoding", n, "of", len(data), "bytes")
+		}
+	}
+}
+
+func TestHashRing_Equal(t *testing.T) {
+	build := func(opts ...Option) *HashRing {
+		r := NewHashRing(opts...)
+		r.AddNodes(map[string]int{"192.168.1.1": 1, "192.168.1.2": 2})
+		return r
+	}
+	r := build()
+	if !r.Equal(build()) || !r.Equal(r) || !r.Equal(r.Clone()) {
+		t.Error("identical rings are not equal")
+	}
+
+	other := build()
+	other.UpdateWeight("192.168.1.2", 3)
+	if r.Equal(other) {
+		t.Error("rings with different weights are equal")
+	}
+	if r.Equal(build(WithVirtualCubes(64))) {
+		t.Error("rings with different cube numbers are equal")
+	}
+	other = build()
+	other.AddNodeWithCubes("192.168.1.3", 1, 8)
+	other.RemoveNode("192.168.1.3")
+	if !r.Equal(other) {
+		t.Error("ring back to the same nodes is not equal")
+	}
+	other.AddNode("192.168.1.3", 1)
+	if r.Equal(other) || other.Equal(r) {
+		t.Error("rings with different members are equal")
+	}
+	if r.Equal(nil) || !(*HashRing)(nil).Equal(nil) {
+		t.Error("nil rings compare wrong")
+	}
+
+	// opposite comparisons run concurrently with writers
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(3)
+		go func() { defer wg.Done(); r.Equal(other) }()
+		go func() { defer wg.Done(); other.Equal(r) }()
+		go func() { defer wg.Done(); other.UpdateWeight("192.168.1.3", i%3+1) }()
+	}
+	wg.Wait()
+}
+
+func TestHashRing_WriteToReadFrom(t *testing.T) {
+	r := NewHashRing(WithVirtualCubes(16))
+	nodes := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		nodes["10.0."+strconv.Itoa(i/250)+"."+strconv.Itoa(i%250)] = i%5 + 1
+	}
+	r.AddNodes(nodes)
+	r.AddNodeWithCubes("192.168.1.1", 2, 40)
+
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(int(n), buf.Len(), t)
+	data := buf.Bytes()
+
+	decoded := NewHashRing()
+	decoded.AddNode("192.168.2.1", 1)
+	m, err := decoded.ReadFrom(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(int(m), len(data), t)
+	if !decoded.Equal(r) {
+		t.Error("decoded ring is not equal to the original")
+	}
+	checkEqual(decoded.cubes["192.168.1.1"], 40, t)
+	checkEqual(len(decoded.sortedRing), len(r.sortedRing), t)
+	checkSamePlacement(r, decoded, t)
+
+	// truncated and corrupt input fail and leave the ring unchanged
+	for _, bad := range [][]byte{
+		nil,
+		data[:1],
+		data[:len(data)/2],
+		data[:len(data)-1],
+		append([]byte{9}, data[1:]...),
+	} {
+		target := NewHashRing()
+		target.AddNode("192.168.2.1", 1)
+		if _, err := target.ReadFrom(bytes.NewReader(bad)); err == nil {
+			t.Error("expected an error for", len(bad), "bytes of input")
+		}
+		checkEqual(target.NodeCount(), 1, t)
+	}
+
+	var _ io.WriterTo = r
+	var _ io.ReaderFrom = r
+}
+
+func TestHashRing_DecodeOversized(t *testing.T) {
+	// one node "a" of weight 2^31-1 with the default cubes per weight
+	bad := []byte{binaryVersion, 0x80, 0x01, 0, 1, 1, 'a', 0xff, 0xff, 0xff, 0xff, 0x07, 0}
+	target := NewHashRing()
+	target.AddNode("192.168.2.1", 1)
+	if _, err := target.ReadFrom(bytes.NewReader(bad)); err == nil {
+		t.Error("expected an error for a weight of 2^31-1")
+	}
+	checkEqual(target.NodeCount(), 1, t)
+
+	for _, data := range []string{
+		`{"cubes":128,"weights":{"a":2147483647}}`,
+		`{"cubes":2147483647,"weights":{"a":1}}`,
+		`{"weights":{"a":1},"nodeCubes":{"a":2147483647}}`,
+	} {
+		if err := json.Unmarshal([]byte(data), target); err == nil {
+			t.Error("expected an error decoding", data)
+		}
+		checkEqual(target.NodeCount(), 1, t)
+	}
+
+	// the receiver's weight cap applies to decoded rings
+	r := NewHashRing()
+	r.AddNode("192.168.1.1", 10)
+	data, err := r.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	capped := NewHashRing(WithWeightCap(5))
+	if err := capped.GobDecode(data); err == nil {
+		t.Error("expected an error decoding a weight above the cap")
+	}
+	checkEqual(capped.NodeCount(), 0, t)
+	if err := NewHashRing(WithWeightCap(10)).GobDecode(data); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHashRing_WeightScaleEncoding(t *testing.T) {
+	r := NewHashRing()
+	r.AddNode("192.168.1.1", 1)
+	r.AddNodeFloat("192.168.1.2", 1.5)
+	checkEqual(r.WeightScale(), 10, t)
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromBinary, fromJSON := NewHashRing(), NewHashRing()
+	if _, err := fromBinary.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	for _, decoded := range []*HashRing{fromBinary, fromJSON} {
+		checkEqual(decoded.WeightScale(), 10, t)
+		if !decoded.Equal(r) {
+			t.Error("decoded ring is not equal to the original")
+		}
+		// the scale is kept, a new float weight does not rescale the ring
+		decoded.AddNodeFloat("192.168.1.3", 2.5)
+		checkEqual(decoded.weights["192.168.1.1"], 10, t)
+		checkEqual(decoded.weights["192.168.1.3"], 25, t)
+	}
+
+	unscaled := NewHashRing()
+	unscaled.AddNodes(map[string]int{"192.168.1.1": 10, "192.168.1.2": 15})
+	if unscaled.Equal(r) || r.Equal(unscaled) {
+		t.Error("rings with different weight scales are equal")
+	}
+
+	// version 1 has no weight scale
+	v1 := []byte{1, 0x80, 0x01, 1, 1, 'a', 2, 0}
+	decoded := NewHashRing()
+	if _, err := decoded.ReadFrom(bytes.NewReader(v1)); err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(decoded.weights["a"], 2, t)
+	checkEqual(decoded.WeightScale(), 1, t)
+
+	if err := json.Unmarshal([]byte(`{"weights":{"a":1},"weightScale":-1}`), decoded); err == nil {
+		t.Error("expected an error for a negative weight scale")
+	}
+}
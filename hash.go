@@ -0,0 +1,62 @@
+package consistentHash
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// Murmur3Hash is the 32-bit MurmurHash3 of data with seed 0, a HashFunc
+// spreading similar keys more evenly than CRC32
+func Murmur3Hash(data []byte) uint32 {
+	return murmur3(data, 0)
+}
+
+// murmur3: MurmurHash3_x86_32
+func murmur3(data []byte, seed uint32) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+
+	h := seed
+	n := len(data) / 4 * 4
+	for i := 0; i < n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+
+	var k uint32
+	switch len(data) - n {
+	case 3:
+		k ^= uint32(data[n+2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(data[n+1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(data[n])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	return fmix32(h)
+}
+
+// fmix32: the final mix of MurmurHash3, a bijection on uint32
+func fmix32(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
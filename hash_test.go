@@ -0,0 +1,57 @@
+package consistentHash
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestMurmur3Hash(t *testing.T) {
+	testHash := []struct {
+		in   string
+		seed uint32
+		out  uint32
+	}{
+		{"", 0, 0},
+		{"", 1, 0x514e28b7},
+		{"abc", 0, 0xb3dd93fa},
+		{"hello", 0, 0x248bfa47},
+		{"The quick brown fox jumps over the lazy dog", 0, 0x2e4ff723},
+	}
+	for i, v := range testHash {
+		if h := murmur3([]byte(v.in), v.seed); h != v.out {
+			t.Errorf("index %d err: got %#x, expected %#x", i, h, v.out)
+		}
+	}
+	if Murmur3Hash([]byte("hello")) != 0x248bfa47 {
+		t.Error("Murmur3Hash does not use seed 0")
+	}
+}
+
+// shareRatio: largest over smallest keyspace share of the nodes
+func shareRatio(r *HashRing) float64 {
+	min, max := 1.0, 0.0
+	for _, share := range r.Distribution() {
+		if share < min {
+			min = share
+		}
+		if share > max {
+			max = share
+		}
+	}
+	return max / min
+}
+
+func TestMurmur3Hash_Dispersion(t *testing.T) {
+	crcRing := NewHashRing()
+	murmurRing := NewHashRing(WithHashFunc(Murmur3Hash))
+	for i := 0; i < 10; i++ {
+		ip := "192.168.1." + strconv.Itoa(i+1)
+		crcRing.AddNode(ip, 1)
+		murmurRing.AddNode(ip, 1)
+	}
+
+	crcRatio, murmurRatio := shareRatio(crcRing), shareRatio(murmurRing)
+	if murmurRatio >= crcRatio {
+		t.Error("max/min share ratio of Murmur3", murmurRatio, "is not better than CRC32", crcRatio)
+	}
+}
@@ -0,0 +1,192 @@
+package consistentHash
+
+import (
+	"errors"
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// Implement sort interface
+type uint64Array []uint64
+
+func (x uint64Array) Len() int           { return len(x) }
+func (x uint64Array) Less(i, j int) bool { return x[i] < x[j] }
+func (x uint64Array) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+
+// HashRing64 is a HashRing with 64-bit ring positions hashed by FNV-1a.
+// Large rings lose far fewer virtual cubes to hash collisions than on
+// the 32-bit HashRing.
+type HashRing64 struct {
+	ring          map[uint64]string
+	sortedRing    uint64Array
+	members       map[string]bool
+	weights       map[string]int
+	numberOfCubes int
+	sync.RWMutex
+}
+
+// NewHashRing64 creates an empty 64-bit hash ring
+func NewHashRing64() *HashRing64 {
+	return &HashRing64{
+		ring:          make(map[uint64]string),
+		members:       make(map[string]bool),
+		weights:       make(map[string]int),
+		numberOfCubes: DefaultVirtualCubes,
+	}
+}
+
+// Set the number of virtual cubes per node
+// Notice: SetCubeNumber must be called before AddNode or AddNodes
+func (r *HashRing64) SetCubeNumber(num int) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.members) != 0 {
+		return errors.New("nodes already exist in the ring, modify cube number is not allowed")
+	}
+	if num <= 0 {
+		return errors.New("num must be more than 0, suggest more than 32")
+	}
+	r.numberOfCubes = num
+	return nil
+}
+
+// Get the real nodes in the consistent hash ring
+func (r *HashRing64) Members() []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	var m []string
+	for k := range r.members {
+		m = append(m, k)
+	}
+	return m
+}
+
+// Generate 64-bit hash value based on the key
+func (r *HashRing64) generateHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// addNode: place the virtual cubes of a node, an existing node with a
+// lower weight drops its cubes above the new weight. The caller holds the lock
+func (r *HashRing64) addNode(ip string, weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
+	r.removeCubes(ip, r.numberOfCubes*weight, r.numberOfCubes*r.weights[ip])
+	for i := 0; i < r.numberOfCubes*weight; i++ {
+		r.ring[r.generateHash(generateKey(ip, i))] = ip
+	}
+	r.members[ip] = true
+	r.weights[ip] = weight
+}
+
+// AddNode: add a node in the consistent hash ring.
+func (r *HashRing64) AddNode(ip string, weight int) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.addNode(ip, weight)
+	r.updateSortedRing()
+}
+
+// AddNodes: add multiple nodes at once
+// Param: map, key is real node ip, value is this node's weight
+func (r *HashRing64) AddNodes(ipWeight map[string]int) {
+	r.Lock()
+	defer r.Unlock()
+
+	for ip, weight := range ipWeight {
+		r.addNode(ip, weight)
+	}
+	r.updateSortedRing()
+}
+
+// RemoveNode: removes a node from the consistent hash ring.
+func (r *HashRing64) RemoveNode(elt string) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.removeCubes(elt, 0, r.numberOfCubes*r.weights[elt])
+	delete(r.members, elt)
+	delete(r.weights, elt)
+	r.updateSortedRing()
+}
+
+// removeCubes: delete the virtual cubes [from, to) of a node which it
+// still owns, the caller holds the lock
+func (r *HashRing64) removeCubes(ip string, from, to int) {
+	for i := from; i < to; i++ {
+		hash := r.generateHash(generateKey(ip, i))
+		if r.ring[hash] == ip {
+			delete(r.ring, hash)
+		}
+	}
+}
+
+// GetNode returns a node close to where name hashes to in the ring.
+func (r *HashRing64) GetNode(name string) (string, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	if len(r.ring) == 0 {
+		return "", ErrEmptyRing
+	}
+	index := r.search(r.generateHash(name))
+	return r.ring[r.sortedRing[index]], nil
+}
+
+// GetNodes returns the N closest distinct real nodes to the name input in the ring.
+func (r *HashRing64) GetNodes(name string, n int) (nodes []string, err error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	if len(r.ring) == 0 {
+		return nil, ErrEmptyRing
+	}
+	if len(r.members) < n {
+		n = len(r.members)
+	}
+
+	start := r.search(r.generateHash(name))
+	seen := make(map[string]struct{}, n)
+	for i := start; len(nodes) < n; {
+		elem := r.ring[r.sortedRing[i]]
+		if _, ok := seen[elem]; !ok {
+			seen[elem] = struct{}{}
+			nodes = append(nodes, elem)
+		}
+		if i++; i >= len(r.sortedRing) {
+			i = 0
+		}
+		if i == start {
+			break
+		}
+	}
+	return
+}
+
+// search: find the cube of key's hash value clockwise
+func (r *HashRing64) search(key uint64) (index int) {
+	index = sort.Search(len(r.sortedRing), func(x int) bool {
+		return r.sortedRing[x] > key
+	})
+	if index >= len(r.sortedRing) {
+		index = 0
+	}
+	return
+}
+
+// updateSortedRing: when hash ring is change, update sortedRing
+func (r *HashRing64) updateSortedRing() {
+	hashes := make(uint64Array, 0, len(r.ring))
+	for k := range r.ring {
+		hashes = append(hashes, k)
+	}
+	sort.Sort(hashes)
+	r.sortedRing = hashes
+}
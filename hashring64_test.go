@@ -0,0 +1,93 @@
+package consistentHash
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestHashRing64_AddNode(t *testing.T) {
+	r := NewHashRing64()
+	r.AddNode("192.168.1.10", 1)
+	checkEqual(len(r.ring), DefaultVirtualCubes, t)
+	checkEqual(len(r.sortedRing), DefaultVirtualCubes, t)
+	if sort.IsSorted(r.sortedRing) == false {
+		t.Errorf("expected sorted ring to be sorted")
+	}
+}
+
+func TestHashRing64_NoCollisions(t *testing.T) {
+	r := NewHashRing64()
+	Nodes := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		Nodes["10.0."+strconv.Itoa(i/256)+"."+strconv.Itoa(i%256)] = 10
+	}
+	r.AddNodes(Nodes)
+	checkEqual(len(r.sortedRing), DefaultVirtualCubes*1000, t)
+}
+
+func TestHashRing64_RemoveNode(t *testing.T) {
+	r := NewHashRing64()
+	r.AddNode("192.168.1.1", 1)
+	r.AddNode("192.168.1.2", 2)
+	r.RemoveNode("192.168.1.2")
+	checkEqual(len(r.ring), DefaultVirtualCubes, t)
+	checkEqual(len(r.Members()), 1, t)
+	r.RemoveNode("192.168.1.1")
+	checkEqual(len(r.sortedRing), 0, t)
+}
+
+func TestHashRing64_ReAddLowerWeight(t *testing.T) {
+	r := NewHashRing64()
+	r.AddNode("192.168.1.1", 1)
+	r.AddNode("x", 3)
+	r.AddNode("x", 1)
+	checkEqual(len(r.ring), 2*DefaultVirtualCubes, t)
+	checkEqual(len(r.sortedRing), 2*DefaultVirtualCubes, t)
+
+	r.RemoveNode("x")
+	checkEqual(len(r.ring), DefaultVirtualCubes, t)
+	for _, node := range r.ring {
+		if node == "x" {
+			t.Fatal("cube of the removed node x left in the ring")
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if node, _ := r.GetNode("key" + strconv.Itoa(i)); node != "192.168.1.1" {
+			t.Fatal("got", node, ", expected 192.168.1.1")
+		}
+	}
+}
+
+func TestHashRing64_GetNodes(t *testing.T) {
+	r := NewHashRing64()
+	if _, err := r.GetNode("key1"); err == nil {
+		t.Error("expected error on empty ring")
+	}
+	if _, err := r.GetNodes("key1", 3); err == nil {
+		t.Error("expected error on empty ring")
+	}
+
+	for i := 0; i < 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i+1), i+1)
+	}
+	node, err := r.GetNode("key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := r.GetNodes("key1", 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(len(nodes), 10, t)
+	if nodes[0] != node {
+		t.Error("first node error, expected", node, "but got", nodes[0])
+	}
+	seen := make(map[string]bool)
+	for _, n := range nodes {
+		if seen[n] {
+			t.Error("duplicate node", n)
+		}
+		seen[n] = true
+	}
+}
@@ -0,0 +1,78 @@
+package consistentHash
+
+import "sync"
+
+// HealthRing routes lookups of a HashRing around unhealthy nodes. Marking a
+// node unhealthy leaves the cubes untouched: only the keys of that node move
+// to the next healthy node clockwise, and they come back once it is healthy.
+// ring:      the underlying hash ring, nodes are added and removed on it
+// unhealthy: set of the nodes marked unhealthy
+type HealthRing struct {
+	ring      *HashRing
+	unhealthy map[string]struct{}
+	sync.RWMutex
+}
+
+// NewHealthRing creates a HealthRing on ring where every node is healthy
+func NewHealthRing(ring *HashRing) *HealthRing {
+	return &HealthRing{
+		ring:      ring,
+		unhealthy: make(map[string]struct{}),
+	}
+}
+
+// Ring returns the underlying hash ring
+func (h *HealthRing) Ring() *HashRing {
+	return h.ring
+}
+
+// SetHealthy: mark a node healthy or unhealthy, a node is healthy by default
+func (h *HealthRing) SetHealthy(ip string, healthy bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	if healthy {
+		delete(h.unhealthy, ip)
+	} else {
+		h.unhealthy[ip] = struct{}{}
+	}
+}
+
+// IsHealthy reports whether ip is not marked unhealthy
+func (h *HealthRing) IsHealthy(ip string) bool {
+	h.RLock()
+	defer h.RUnlock()
+
+	_, ok := h.unhealthy[ip]
+	return !ok
+}
+
+// GetNode returns the first healthy node clockwise from where name hashes to
+func (h *HealthRing) GetNode(name string) (string, error) {
+	nodes, err := h.GetNodes(name, 1)
+	if err != nil {
+		return "", err
+	}
+	return nodes[0], nil
+}
+
+// GetNodes returns up to n distinct healthy nodes clockwise from where name
+// hashes to
+func (h *HealthRing) GetNodes(name string, n int) (nodes []string, err error) {
+	s := h.ring.loadSnapshot()
+	if len(s.sortedRing) == 0 {
+		return nil, ErrEmptyRing
+	}
+
+	h.RLock()
+	defer h.RUnlock()
+
+	nodes = s.distinctNodesFrom(s.search(s.hash(name)), n, func(node string) bool {
+		_, sick := h.unhealthy[node]
+		return sick
+	})
+	if len(nodes) == 0 && n > 0 {
+		return nil, ErrNoNodeAvailable
+	}
+	return nodes, nil
+}
@@ -0,0 +1,66 @@
+package consistentHash
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHealthRing_SetHealthy(t *testing.T) {
+	r := NewHashRing()
+	for i := 1; i <= 5; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i), 1)
+	}
+	h := NewHealthRing(r)
+
+	before := make(map[string]string)
+	for i := 0; i < 10000; i++ {
+		key := "key" + strconv.Itoa(i)
+		before[key], _ = h.GetNode(key)
+	}
+
+	h.SetHealthy("192.168.1.3", false)
+	if h.IsHealthy("192.168.1.3") {
+		t.Error("192.168.1.3 should be unhealthy")
+	}
+	for key, node := range before {
+		got, _ := h.GetNode(key)
+		if got == "192.168.1.3" {
+			t.Fatal("key", key, "routed to unhealthy node")
+		}
+		if node != "192.168.1.3" && got != node {
+			t.Fatal("key", key, "of a healthy node moved from", node, "to", got)
+		}
+	}
+	checkEqual(len(r.sortedRing), DefaultVirtualCubes*5, t)
+
+	h.SetHealthy("192.168.1.3", true)
+	for key, node := range before {
+		if got, _ := h.GetNode(key); got != node {
+			t.Fatal("key", key, "got", got, ", expected", node)
+		}
+	}
+}
+
+func TestHealthRing_GetNodes(t *testing.T) {
+	r := NewHashRing()
+	h := NewHealthRing(r)
+	if _, err := h.GetNode("key"); err == nil {
+		t.Error("expected an error on an empty ring")
+	}
+
+	r.AddNodes(map[string]int{"192.168.1.1": 1, "192.168.1.2": 1, "192.168.1.3": 1})
+	h.SetHealthy("192.168.1.2", false)
+	nodes, _ := h.GetNodes("key", 3)
+	checkEqual(len(nodes), 2, t)
+	for _, node := range nodes {
+		if node == "192.168.1.2" {
+			t.Error("got unhealthy node", node)
+		}
+	}
+
+	h.SetHealthy("192.168.1.1", false)
+	h.SetHealthy("192.168.1.3", false)
+	if _, err := h.GetNode("key"); err == nil {
+		t.Error("expected an error when every node is unhealthy")
+	}
+}
@@ -0,0 +1,98 @@
+package consistentHash
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// JumpRing places keys on a fixed list of shards numbered 0..N-1 by jump
+// consistent hash (Lamping and Veach, 2014). It keeps no virtual cubes,
+// only the node of each bucket, and going from N to N+1 buckets only moves
+// 1/(N+1) of the keys. Buckets can only be added or removed at the tail:
+// removing a node in the middle renumbers the next ones and moves their keys.
+// nodes: slice, nodes[i] is the node of bucket i
+type JumpRing struct {
+	nodes []string
+	sync.RWMutex
+}
+
+// NewJumpRing creates a ring whose i-th bucket is nodes[i]
+func NewJumpRing(nodes ...string) *JumpRing {
+	return &JumpRing{nodes: append([]string(nil), nodes...)}
+}
+
+// GetBucket returns the bucket of key among numBuckets by jump consistent
+// hash, -1 if numBuckets is not positive. It does not depend on the nodes
+// of the ring.
+func (r *JumpRing) GetBucket(key uint64, numBuckets int) int32 {
+	b, j := int64(-1), int64(0)
+	for j < int64(numBuckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int32(b)
+}
+
+// Append adds node as the last bucket
+func (r *JumpRing) Append(node string) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.nodes = append(r.nodes, node)
+}
+
+// RemoveLast removes the last bucket and returns its node, false if the
+// ring is empty
+func (r *JumpRing) RemoveLast() (string, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.nodes) == 0 {
+		return "", false
+	}
+	node := r.nodes[len(r.nodes)-1]
+	r.nodes = r.nodes[:len(r.nodes)-1]
+	return node, true
+}
+
+// Node returns the node of bucket, false if there is no such bucket
+func (r *JumpRing) Node(bucket int) (string, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	if bucket < 0 || bucket >= len(r.nodes) {
+		return "", false
+	}
+	return r.nodes[bucket], true
+}
+
+// Nodes returns a copy of the nodes in bucket order
+func (r *JumpRing) Nodes() []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	return append([]string(nil), r.nodes...)
+}
+
+// Len returns the number of buckets
+func (r *JumpRing) Len() int {
+	r.RLock()
+	defer r.RUnlock()
+
+	return len(r.nodes)
+}
+
+// GetNode returns the node of the bucket of name, hashed by FNV-1a 64
+func (r *JumpRing) GetNode(name string) (string, error) {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+
+	r.RLock()
+	defer r.RUnlock()
+
+	if len(r.nodes) == 0 {
+		return "", ErrEmptyRing
+	}
+	return r.nodes[r.GetBucket(h.Sum64(), len(r.nodes))], nil
+}
@@ -0,0 +1,83 @@
+package consistentHash
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func TestJumpRing_GetBucket(t *testing.T) {
+	// values of the reference implementation of the paper
+	tests := []struct {
+		key      uint64
+		buckets  int
+		expected int32
+	}{
+		{1, 1, 0},
+		{42, 57, 43},
+		{0xDEAD10CC, 1, 0},
+		{0xDEAD10CC, 666, 361},
+		{256, 1024, 520},
+		{1, 10, 6},
+		{12345, 100, 29},
+		{1<<64 - 1, 1000, 313},
+		{42, 0, -1},
+	}
+	r := NewJumpRing()
+	for _, test := range tests {
+		if got := r.GetBucket(test.key, test.buckets); got != test.expected {
+			t.Error(test.key, test.buckets, "got", got, ", expected", test.expected)
+		}
+	}
+}
+
+func TestJumpRing_Grow(t *testing.T) {
+	r := NewJumpRing()
+	if _, err := r.GetNode("key1"); err != ErrEmptyRing {
+		t.Error("empty ring got", err, ", expected", ErrEmptyRing)
+	}
+	for i := 0; i < 10; i++ {
+		r.Append("shard" + strconv.Itoa(i))
+	}
+	checkEqual(r.Len(), 10, t)
+	if node, ok := r.Node(3); !ok || node != "shard3" {
+		t.Error("bucket 3 got", node, ok)
+	}
+	if _, ok := r.Node(10); ok {
+		t.Error("expected no bucket 10")
+	}
+
+	before := make(map[string]string)
+	for i := 0; i < 10000; i++ {
+		key := "key" + strconv.Itoa(i)
+		before[key], _ = r.GetNode(key)
+	}
+
+	// a new shard only takes keys, about 1/11 of them
+	r.Append("shard10")
+	moved := 0
+	for key, old := range before {
+		node, _ := r.GetNode(key)
+		if node != old {
+			if node != "shard10" {
+				t.Fatal(key, "moved from", old, "to", node)
+			}
+			moved++
+		}
+	}
+	if moved < 700 || moved > 1100 {
+		t.Error("moved", moved, "keys, expected about 909")
+	}
+
+	if node, ok := r.RemoveLast(); !ok || node != "shard10" {
+		t.Error("removed", node, ok)
+	}
+	for key, old := range before {
+		if node, _ := r.GetNode(key); node != old {
+			t.Fatal(key, "got", node, ", expected", old)
+		}
+	}
+	if fmt.Sprint(r.Nodes()[:2]) != "[shard0 shard1]" {
+		t.Error("got", r.Nodes())
+	}
+}
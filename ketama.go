@@ -0,0 +1,54 @@
+package consistentHash
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"strconv"
+)
+
+// KetamaPoints is the number of ring points of a libketama server,
+// 40 MD5 digests of 4 points each
+const KetamaPoints = 160
+
+// NewKetamaRing creates a ring placing keys like libketama and the ketama
+// clients of memcached: the points of a node are the 4 little endian words
+// of the MD5 digests of "ip-0", "ip-1"..., KetamaPoints points per weight,
+// and a key belongs to the first point at or after its KetamaHash.
+// With equal weights the placement is identical to libketama, which
+// instead splits its points between servers by their share of the total
+// weight. opts are applied after the ketama defaults.
+func NewKetamaRing(opts ...Option) *HashRing {
+	r := NewHashRing(
+		WithKeyFunc(KetamaKeyFunc),
+		WithHashFunc(KetamaHash),
+		WithInclusiveSearch(true),
+		WithVirtualCubes(KetamaPoints),
+	)
+	r.ketama = true
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.presize()
+	return r
+}
+
+// KetamaKeyFunc formats cube keys as libketama does: "ip-index"
+func KetamaKeyFunc(ip string, index int) string {
+	return ip + "-" + strconv.Itoa(index)
+}
+
+// KetamaHash is the hash of libketama: the first 4 bytes of the MD5 digest
+// of data, little endian
+func KetamaHash(data []byte) uint32 {
+	digest := md5.Sum(data)
+	return binary.LittleEndian.Uint32(digest[:4])
+}
+
+// ketamaPoints: the 4 ring points libketama derives from the digest of key
+func ketamaPoints(key string) (points [4]uint32) {
+	digest := md5.Sum([]byte(key))
+	for h := range points {
+		points[h] = binary.LittleEndian.Uint32(digest[h*4:])
+	}
+	return
+}
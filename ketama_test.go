@@ -0,0 +1,88 @@
+package consistentHash
+
+import "testing"
+
+func TestKetamaHash(t *testing.T) {
+	// values of ketama_hashi in libketama
+	vectors := map[string]uint32{
+		"foo":               3675831724,
+		"127.0.0.1:11211-0": 2589391586,
+		"127.0.0.1:11211-1": 3742049157,
+		"127.0.0.1:11212-0": 647876633,
+	}
+	for key, expected := range vectors {
+		if got := KetamaHash([]byte(key)); got != expected {
+			t.Error(key, "got", got, ", expected", expected)
+		}
+	}
+}
+
+func TestWithKeyFunc_Ketama(t *testing.T) {
+	r := NewHashRing(WithKeyFunc(KetamaKeyFunc), WithHashFunc(KetamaHash), WithVirtualCubes(2))
+	r.AddNode("127.0.0.1:11211", 1)
+	r.AddNode("127.0.0.1:11212", 1)
+
+	checkEqual(len(r.sortedRing), 4, t)
+	for hash, node := range map[uint32]string{
+		2589391586: "127.0.0.1:11211",
+		3742049157: "127.0.0.1:11211",
+		647876633:  "127.0.0.1:11212",
+	} {
+		if r.ring[hash] != node {
+			t.Error("point", hash, "got", r.ring[hash], ", expected", node)
+		}
+	}
+
+	// the default key format is unchanged
+	d := NewHashRing(WithVirtualCubes(2))
+	d.AddNode("127.0.0.1:11211", 1)
+	if _, ok := d.ring[KetamaHash([]byte("127.0.0.1:11211-0"))]; ok {
+		t.Error("default ring uses the ketama key format")
+	}
+	if _, ok := d.ring[d.generateHash("127.0.0.1:11211#0")]; !ok {
+		t.Error("default ring misses the cube 127.0.0.1:11211#0")
+	}
+}
+
+func TestKetamaPoints(t *testing.T) {
+	expected := [4]uint32{2589391586, 1482608462, 2562656683, 1506298073}
+	if got := ketamaPoints("127.0.0.1:11211-0"); got != expected {
+		t.Error("got", got, ", expected", expected)
+	}
+}
+
+func TestNewKetamaRing(t *testing.T) {
+	r := NewKetamaRing()
+	for _, ip := range []string{"10.0.1.1:11211", "10.0.1.2:11211", "10.0.1.3:11211"} {
+		r.AddNode(ip, 1)
+	}
+	checkEqual(len(r.sortedRing), 3*KetamaPoints, t)
+	checkEqual(countCubes(r, "10.0.1.2:11211"), KetamaPoints, t)
+	if r.sortedRing[0] != 4826654 || r.ring[4826654] != "10.0.1.2:11211" {
+		t.Error("first point got", r.sortedRing[0], r.ring[r.sortedRing[0]])
+	}
+
+	// placement of a libketama continuum built from the same servers
+	vectors := map[string]string{
+		"foo":         "10.0.1.2:11211",
+		"bar":         "10.0.1.1:11211",
+		"baz":         "10.0.1.2:11211",
+		"key1":        "10.0.1.2:11211",
+		"key2":        "10.0.1.1:11211",
+		"key3":        "10.0.1.1:11211",
+		"user:1001":   "10.0.1.1:11211",
+		"user:1002":   "10.0.1.3:11211",
+		"session:abc": "10.0.1.2:11211",
+		"memcached":   "10.0.1.3:11211",
+	}
+	for key, expected := range vectors {
+		if got, _ := r.GetNode(key); got != expected {
+			t.Error(key, "got", got, ", expected", expected)
+		}
+	}
+
+	r.UpdateWeight("10.0.1.1:11211", 2)
+	checkEqual(countCubes(r, "10.0.1.1:11211"), 2*KetamaPoints, t)
+	r.RemoveNode("10.0.1.1:11211")
+	checkEqual(len(r.sortedRing), 2*KetamaPoints, t)
+}
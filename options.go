@@ -0,0 +1,129 @@
+package consistentHash
+
+import "hash/crc32"
+
+// Option configures a HashRing created by NewHashRing
+type Option func(r *HashRing)
+
+// WithHashFunc: hash virtual keys and lookup names with fn instead of CRC32-IEEE
+func WithHashFunc(fn HashFunc) Option {
+	return func(r *HashRing) {
+		r.hashFunc = fn
+	}
+}
+
+// castagnoliTable is built once for WithCRC32Castagnoli
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// castagnoliHash: CRC32-C of data, hardware accelerated on most CPUs
+func castagnoliHash(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoliTable)
+}
+
+// WithCRC32Castagnoli: hash with CRC32-C instead of CRC32-IEEE, which is
+// faster on CPUs with a CRC32 instruction and spreads keys better
+func WithCRC32Castagnoli() Option {
+	return WithHashFunc(castagnoliHash)
+}
+
+// WithKeyFunc: format the keys of virtual cubes with fn instead of "ip#index"
+func WithKeyFunc(fn KeyFunc) Option {
+	return func(r *HashRing) {
+		r.keyFunc = fn
+	}
+}
+
+// WithSeed: salt every hash of the ring with seed, so that rings with the
+// same nodes but different seeds place keys independently. 0 means no salt.
+func WithSeed(seed uint32) Option {
+	return func(r *HashRing) {
+		r.seed = seed
+	}
+}
+
+// MinKeyspaceBits is the smallest keyspace width accepted by WithKeyspaceBits
+const MinKeyspaceBits = 8
+
+// WithKeyspaceBits: keep only the low bits of every hash of the ring, so
+// that cubes and names land in [0, 2^bits). A narrow keyspace makes the
+// hashes compact but collisions more frequent: with 2^bits positions, about
+// cubes^2 / 2^(bits+1) cubes are lost. Widths out of [MinKeyspaceBits, 32]
+// are ignored.
+func WithKeyspaceBits(bits int) Option {
+	return func(r *HashRing) {
+		if bits >= MinKeyspaceBits && bits <= 32 {
+			r.keyBits = bits
+		}
+	}
+}
+
+// WithInclusiveSearch: when inclusive, a name whose hash equals the hash of
+// a cube belongs to that cube. By default it belongs to the next cube
+// clockwise, i.e. a cube owns the hashes from the previous cube included
+// up to itself excluded.
+func WithInclusiveSearch(inclusive bool) Option {
+	return func(r *HashRing) {
+		r.inclusive = inclusive
+	}
+}
+
+// WithVirtualCubes: use num virtual cubes per node instead of DefaultVirtualCubes,
+// a non-positive num is ignored
+func WithVirtualCubes(num int) Option {
+	return func(r *HashRing) {
+		if num > 0 {
+			r.numberOfCubes = num
+		}
+	}
+}
+
+// WithExpectedNodes: size the ring for about n nodes of weight 1, so that
+// building it, e.g. by AddNodes, does not grow its maps over and over.
+// It only changes allocations, a non-positive n is ignored.
+func WithExpectedNodes(n int) Option {
+	return func(r *HashRing) {
+		if n > 0 {
+			r.expectedNodes = n
+		}
+	}
+}
+
+// WithLookupCache: cache the nodes of the last size names given to
+// GetNode, for workloads with a small set of hot names. Any change of the
+// ring invalidates the cache. A non-positive size means no cache.
+func WithLookupCache(size int) Option {
+	return func(r *HashRing) {
+		if size > 0 {
+			r.cache = newLookupCache(size)
+		}
+	}
+}
+
+// WithLogger: call fn on significant events of the ring: nodes added and
+// removed, cubes colliding and lookups on an empty ring. Changes are logged
+// while holding the lock of the ring, so fn must not use the ring.
+func WithLogger(fn func(format string, args ...any)) Option {
+	return func(r *HashRing) {
+		r.logger = fn
+	}
+}
+
+// WithStickyWindow: make GetNodeSticky look n cubes ahead instead of
+// DefaultStickyWindow, non-positive values are ignored
+func WithStickyWindow(n int) Option {
+	return func(r *HashRing) {
+		if n > 0 {
+			r.stickyWindow = n
+		}
+	}
+}
+
+// WithWeightCap: reject node weights above max, 0 means no cap. The cap is
+// in unscaled units, see WeightScale.
+func WithWeightCap(max int) Option {
+	return func(r *HashRing) {
+		if max >= 0 {
+			r.maxWeight = max
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package consistentHash
+
+import (
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func fnv32a(data []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(data)
+	return h.Sum32()
+}
+
+func TestWithHashFunc_Default(t *testing.T) {
+	r := NewHashRing()
+	for _, key := range []string{"key1", "192.168.1.1#0", ""} {
+		if r.generateHash(key) != crc32.ChecksumIEEE([]byte(key)) {
+			t.Error("default hash of", key, "is not CRC32-IEEE")
+		}
+	}
+
+	r = NewHashRing(WithHashFunc(fnv32a))
+	if r.generateHash("key1") != fnv32a([]byte("key1")) {
+		t.Error("configured hash function is not used")
+	}
+}
+
+func TestWithHashFunc_GetNode(t *testing.T) {
+	crcRing := NewHashRing()
+	fnvRing := NewHashRing(WithHashFunc(fnv32a))
+	for i := 0; i < 10; i++ {
+		ip := "192.168.1." + strconv.Itoa(i+1)
+		crcRing.AddNode(ip, 1)
+		fnvRing.AddNode(ip, 1)
+	}
+
+	differ := false
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		n1, err := crcRing.GetNode(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n2, err := fnvRing.GetNode(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n1 != n2 {
+			differ = true
+			break
+		}
+	}
+	if !differ {
+		t.Error("expected rings with different hash functions to place some keys differently")
+	}
+}
+
+func TestSetHashFunc(t *testing.T) {
+	r := NewHashRing()
+	if err := r.SetHashFunc(fnv32a); err != nil {
+		t.Fatal(err)
+	}
+	r.AddNode("192.168.1.10", 1)
+	if err := r.SetHashFunc(nil); err == nil {
+		t.Error("expected error when modifying hash function of a non-empty ring")
+	}
+	if r.generateHash("key1") != fnv32a([]byte("key1")) {
+		t.Error("hash function changed although SetHashFunc failed")
+	}
+}
+
+func TestWithVirtualCubes(t *testing.T) {
+	r1 := NewHashRing(WithVirtualCubes(16))
+	r2 := NewHashRing(WithVirtualCubes(64))
+	r3 := NewHashRing(WithVirtualCubes(0))
+	checkEqual(r1.numberOfCubes, 16, t)
+	checkEqual(r2.numberOfCubes, 64, t)
+	checkEqual(r3.numberOfCubes, DefaultVirtualCubes, t)
+
+	r1.AddNode("192.168.1.1", 2)
+	r2.AddNode("192.168.1.1", 2)
+	checkEqual(len(r1.ring), 32, t)
+	checkEqual(len(r2.ring), 128, t)
+	checkEqual(InitHashRing().numberOfCubes, DefaultVirtualCubes, t)
+}
+
+func TestWithWeightCap(t *testing.T) {
+	r := NewHashRing(WithVirtualCubes(10), WithWeightCap(3))
+	if err := r.AddNode("192.168.1.1", 3); err != nil {
+		t.Fatal(err)
+	}
+	err := r.AddNode("192.168.1.2", 100000)
+	if err == nil || !strings.Contains(err.Error(), "192.168.1.2") || !strings.Contains(err.Error(), "3") {
+		t.Error("expected error naming the node and the cap, got", err)
+	}
+	if _, _, err = r.AddNodes(map[string]int{"192.168.1.3": 2, "192.168.1.4": 5}); err == nil {
+		t.Error("expected error adding nodes above the cap")
+	}
+	if err = r.UpdateWeight("192.168.1.1", 4); err == nil {
+		t.Error("expected error updating weight above the cap")
+	}
+	checkEqual(r.NodeCount(), 1, t)
+	checkEqual(r.weights["192.168.1.1"], 3, t)
+	checkEqual(len(r.ring), 30, t)
+	checkEqual(len(r.sortedRing), 30, t)
+
+	if err = r.SetMaxWeight(0); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.AddNode("192.168.1.2", 10); err != nil {
+		t.Error("unexpected error without cap:", err)
+	}
+	if err = r.SetMaxWeight(-1); err == nil {
+		t.Error("expected error on negative cap")
+	}
+}
+
+func TestWithInclusiveSearch(t *testing.T) {
+	points := map[string]uint32{
+		"a#0": 1000,
+		"b#0": 2000,
+		"c#0": 3000,
+		"key": 2000,
+	}
+	testSearch := []struct {
+		inclusive bool
+		out       string
+	}{
+		{false, "c"},
+		{true, "b"},
+	}
+	for _, v := range testSearch {
+		r := NewHashRing(WithVirtualCubes(1), WithHashFunc(tableHash(points)), WithInclusiveSearch(v.inclusive))
+		r.AddNodes(map[string]int{"a": 1, "b": 1, "c": 1})
+		if node, _ := r.GetNode("key"); node != v.out {
+			t.Error("inclusive", v.inclusive, "err: got", node, ", expected", v.out)
+		}
+		if node, _ := r.GetNodeForHash(3000); node != map[bool]string{false: "a", true: "c"}[v.inclusive] {
+			t.Error("inclusive", v.inclusive, "err: hash 3000 placed on", node)
+		}
+	}
+}
+
+func TestWithSeed(t *testing.T) {
+	newRing := func(opts ...Option) *HashRing {
+		r := NewHashRing(opts...)
+		for i := 1; i <= 10; i++ {
+			r.AddNode("192.168.1."+strconv.Itoa(i), 1)
+		}
+		return r
+	}
+	plain, zero := newRing(), newRing(WithSeed(0))
+	r1, r2, r3 := newRing(WithSeed(1)), newRing(WithSeed(1)), newRing(WithSeed(2))
+	ketama1, ketama2 := NewKetamaRing(WithSeed(1)), NewKetamaRing(WithSeed(1))
+	ketama1.AddNode("10.0.1.1:11211", 1)
+	ketama1.AddNode("10.0.1.2:11211", 1)
+	ketama2.AddNode("10.0.1.1:11211", 1)
+	ketama2.AddNode("10.0.1.2:11211", 1)
+
+	differ := 0
+	for i := 0; i < 1000; i++ {
+		key := "key" + strconv.Itoa(i)
+		n1, _ := r1.GetNode(key)
+		if n, _ := r2.GetNode(key); n != n1 {
+			t.Fatal("same seed: key", key, "got", n, "and", n1)
+		}
+		if n, _ := r3.GetNode(key); n != n1 {
+			differ++
+		}
+		n0, _ := plain.GetNode(key)
+		if n, _ := zero.GetNode(key); n != n0 {
+			t.Fatal("seed 0: key", key, "got", n, ", expected", n0)
+		}
+		k1, _ := ketama1.GetNode(key)
+		if k, _ := ketama2.GetNode(key); k != k1 {
+			t.Fatal("same seed ketama: key", key, "got", k, "and", k1)
+		}
+	}
+	// independent placement agrees for about a tenth of the keys
+	if differ < 800 {
+		t.Error("different seeds placed only", differ, "of 1000 keys differently")
+	}
+	if share := ketama1.Distribution()["10.0.1.1:11211"]; share < 0.3 || share > 0.7 {
+		t.Error("seeded ketama ring gives a share of", share, "to one of two nodes")
+	}
+}
+
+func TestWithStickyWindow(t *testing.T) {
+	checkEqual(NewHashRing(WithStickyWindow(0)).stickyWindow, 0, t)
+	r := NewHashRing(WithStickyWindow(3))
+	checkEqual(r.stickyWindow, 3, t)
+	checkEqual(r.Clone().stickyWindow, 3, t)
+}
+
+func TestWithKeyspaceBits(t *testing.T) {
+	checkEqual(NewHashRing(WithKeyspaceBits(4)).keyBits, 0, t)
+	checkEqual(NewHashRing(WithKeyspaceBits(33)).keyBits, 0, t)
+
+	r := NewHashRing(WithKeyspaceBits(16))
+	for i := 1; i <= 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i), 1)
+	}
+	for _, hash := range r.sortedRing {
+		if hash > 65535 {
+			t.Fatal("point", hash, "out of the 16-bit keyspace")
+		}
+	}
+	if r.VirtualNodeCount()+r.CollisionCount() != 10*DefaultVirtualCubes {
+		t.Error("got", r.VirtualNodeCount(), "cubes and", r.CollisionCount(), "collisions")
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		key := "key" + strconv.Itoa(i)
+		node, err := r.GetNode(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash := r.generateHash(key); hash > 65535 {
+			t.Fatal("key", key, "hashes to", hash, "out of the 16-bit keyspace")
+		}
+		if owner, _ := r.GetNodeForHash(r.generateHash(key)); owner != node {
+			t.Fatal("key", key, "got", node, ", expected", owner)
+		}
+		if view, _ := r.Snapshot().GetNode(key); view != node {
+			t.Fatal("view of key", key, "got", view, ", expected", node)
+		}
+		seen[node] = true
+	}
+	checkEqual(len(seen), 10, t)
+}
+
+func TestWithKeyspaceBits_Distribution(t *testing.T) {
+	r := NewHashRing(WithKeyspaceBits(16), WithHashFunc(Murmur3Hash))
+	for i := 1; i <= 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i), 1)
+	}
+	total := 0.0
+	for node, share := range r.Distribution() {
+		if share < 0.05 || share > 0.15 {
+			t.Error("node", node, "got a share of", share, ", expected about 0.1")
+		}
+		total += share
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Error("shares sum to", total, ", expected 1")
+	}
+	if stats := r.Stats(); stats.MaxLoadShare > 0.15 {
+		t.Error("max load share", stats.MaxLoadShare, ", expected about 0.1")
+	}
+
+	var covered uint64
+	for node := range r.Distribution() {
+		for _, rg := range r.Ranges(node) {
+			if rg[0] > 65535 || rg[1] > 65535 {
+				t.Fatal("range", rg, "of node", node, "out of the 16-bit keyspace")
+			}
+			covered += (uint64(rg[1]) - uint64(rg[0]) + 65536) % 65536
+		}
+	}
+	checkEqual(int(covered), 65536, t)
+
+	stats, err := r.AddNodeStats("192.168.1.11", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Fraction < 0.05 || stats.Fraction > 0.15 {
+		t.Error("adding an 11th node moved", stats.Fraction, "of the keyspace, expected about 1/11")
+	}
+}
+
+func TestWithCRC32Castagnoli(t *testing.T) {
+	r := NewHashRing(WithCRC32Castagnoli())
+	ieee := NewHashRing()
+	if got, expected := r.Hash("key1"), crc32.Checksum([]byte("key1"), crc32.MakeTable(crc32.Castagnoli)); got != expected {
+		t.Error("got", got, ", expected", expected)
+	}
+	for i := 1; i <= 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i), 1)
+		ieee.AddNode("192.168.1."+strconv.Itoa(i), 1)
+	}
+	differ := 0
+	for i := 0; i < 1000; i++ {
+		key := "key" + strconv.Itoa(i)
+		n1, _ := r.GetNode(key)
+		n2, _ := ieee.GetNode(key)
+		if n1 != n2 {
+			differ++
+		}
+	}
+	if differ < 500 {
+		t.Error("only", differ, "of 1000 keys placed differently than with IEEE")
+	}
+}
+
+func BenchmarkHash_IEEE(b *testing.B) {
+	r := NewHashRing()
+	b.SetBytes(int64(len("user:session:0123456789abcdef")))
+	for i := 0; i < b.N; i++ {
+		r.Hash("user:session:0123456789abcdef")
+	}
+}
+
+func BenchmarkHash_Castagnoli(b *testing.B) {
+	r := NewHashRing(WithCRC32Castagnoli())
+	b.SetBytes(int64(len("user:session:0123456789abcdef")))
+	for i := 0; i < b.N; i++ {
+		r.Hash("user:session:0123456789abcdef")
+	}
+}
+
+func TestWithExpectedNodes(t *testing.T) {
+	nodes := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		nodes["10.0.0."+strconv.Itoa(i)] = 1
+	}
+	r1 := NewHashRing(WithExpectedNodes(100), WithVirtualCubes(16))
+	r2 := NewHashRing(WithVirtualCubes(16))
+	r1.AddNodes(nodes)
+	r2.AddNodes(nodes)
+	if !r1.Equal(r2) || fmt.Sprint(r1.Entries()) != fmt.Sprint(r2.Entries()) {
+		t.Error("the size hint changed the ring")
+	}
+}
+
+func benchmarkAddNodes(b *testing.B, opts ...Option) {
+	nodes := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		nodes["10.0."+strconv.Itoa(i/256)+"."+strconv.Itoa(i%256)] = 1
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewHashRing(opts...).AddNodes(nodes)
+	}
+}
+
+func BenchmarkHashRing_AddNodes(b *testing.B) {
+	benchmarkAddNodes(b)
+}
+
+func BenchmarkHashRing_AddNodesExpected(b *testing.B) {
+	benchmarkAddNodes(b, WithExpectedNodes(1000))
+}
+
+func TestWithLogger(t *testing.T) {
+	var logs []string
+	r := NewHashRing(WithVirtualCubes(1), WithLogger(func(format string, args ...any) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}), WithHashFunc(tableHash(map[string]uint32{
+		"a#0": 1000, "b#0": 1000, "b#1": 2000,
+	})))
+
+	r.GetNode("key1")
+	r.AddNode("a", 1)
+	r.AddNode("b", 2)
+	r.GetNode("key1")
+	r.RemoveNode("a")
+	expected := []string{
+		`lookup of "key1" on an empty ring`,
+		"node a added with weight 1",
+		"cube 0x000003e8 of node b collides with node a",
+		"node b added with weight 2",
+		"node a removed",
+	}
+	if strings.Join(logs, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got logs\n%s\nexpected\n%s", strings.Join(logs, "\n"), strings.Join(expected, "\n"))
+	}
+
+	// what-if computations on clones log nothing
+	logs = nil
+	r.EstimateRemap("c", 1, []string{"key1"})
+	r.MigrationPlan(map[string]int{"c": 1})
+	if len(logs) != 0 {
+		t.Error("got logs", logs)
+	}
+}
@@ -0,0 +1,92 @@
+package consistentHash
+
+import (
+	"math"
+	"sync"
+)
+
+// RendezvousRing places keys by weighted rendezvous (highest random weight)
+// hashing: every node scores the key and the highest score wins. It keeps
+// no virtual cubes, so it suits small clusters, and removing a node only
+// moves the keys that node owned.
+// members: map, key is real nodes, value is true or false
+// weights: map, key is real nodes, value is this node's weight
+type RendezvousRing struct {
+	members map[string]bool
+	weights map[string]int
+	sync.RWMutex
+}
+
+// NewRendezvousRing creates an empty rendezvous ring
+func NewRendezvousRing() *RendezvousRing {
+	return &RendezvousRing{
+		members: make(map[string]bool),
+		weights: make(map[string]int),
+	}
+}
+
+// Get the real nodes in the ring
+func (r *RendezvousRing) Members() []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	var m []string
+	for k := range r.members {
+		m = append(m, k)
+	}
+	return m
+}
+
+// AddNode: add a node, or change its weight if it already exists.
+// The error is always nil, it matches HashRing.AddNode.
+func (r *RendezvousRing) AddNode(ip string, weight int) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if weight <= 0 {
+		weight = 1
+	}
+	r.members[ip] = true
+	r.weights[ip] = weight
+	return nil
+}
+
+// RemoveNode: remove a node, return false if it is not in the ring
+func (r *RendezvousRing) RemoveNode(ip string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.members[ip]; !ok {
+		return false
+	}
+	delete(r.members, ip)
+	delete(r.weights, ip)
+	return true
+}
+
+// GetNode returns the node with the highest score for name
+func (r *RendezvousRing) GetNode(name string) (string, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	if len(r.members) == 0 {
+		return "", ErrEmptyRing
+	}
+	var node string
+	best := -1.0
+	for ip := range r.members {
+		score := rendezvousScore(name, ip, r.weights[ip])
+		if score > best || (score == best && ip < node) {
+			node, best = ip, score
+		}
+	}
+	return node, nil
+}
+
+// rendezvousScore: weight / -ln(u) where u in (0, 1) is the hash of name
+// and ip. The probability that a node wins is its share of the total weight.
+func rendezvousScore(name, ip string, weight int) float64 {
+	h := murmur3([]byte(name+"\x00"+ip), 0)
+	u := (float64(h) + 0.5) / float64(keyspace)
+	return float64(weight) / -math.Log(u)
+}
@@ -0,0 +1,71 @@
+package consistentHash
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func TestRendezvousRing_GetNode(t *testing.T) {
+	r1 := NewRendezvousRing()
+	if _, err := r1.GetNode("key1"); err == nil {
+		t.Error("expected error on empty ring")
+	}
+	r2 := NewRendezvousRing()
+	for i := 0; i < 10; i++ {
+		r1.AddNode("192.168.1."+strconv.Itoa(i+1), 1)
+		r2.AddNode("192.168.1."+strconv.Itoa(10-i), 1)
+	}
+	checkEqual(len(r1.Members()), 10, t)
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		n1, _ := r1.GetNode(key)
+		n2, _ := r2.GetNode(key)
+		n3, _ := r1.GetNode(key)
+		if n1 != n2 || n1 != n3 {
+			t.Fatal(key, "placed on", n1, n2, n3)
+		}
+	}
+}
+
+func TestRendezvousRing_Weight(t *testing.T) {
+	r := NewRendezvousRing()
+	r.AddNode("192.168.1.1", 1)
+	r.AddNode("192.168.1.2", 3)
+
+	nodeMap := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		node, _ := r.GetNode(fmt.Sprintf("key%d", i))
+		nodeMap[node]++
+	}
+	ratio := float64(nodeMap["192.168.1.2"]) / float64(nodeMap["192.168.1.1"])
+	if ratio < 2.5 || ratio > 3.5 {
+		t.Error("weight 3 node got", ratio, "times the keys of weight 1 node, expected about 3")
+	}
+}
+
+func TestRendezvousRing_RemoveNode(t *testing.T) {
+	r := NewRendezvousRing()
+	for i := 0; i < 5; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i+1), i+1)
+	}
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		before[key], _ = r.GetNode(key)
+	}
+
+	if !r.RemoveNode("192.168.1.3") || r.RemoveNode("192.168.1.3") {
+		t.Error("RemoveNode reported a wrong presence")
+	}
+	for key, old := range before {
+		node, _ := r.GetNode(key)
+		if old != "192.168.1.3" && node != old {
+			t.Error(key, "moved from", old, "to", node)
+		}
+		if node == "192.168.1.3" {
+			t.Error(key, "still placed on the removed node")
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package consistentHash
+
+import "sort"
+
+// emptySnapshot is the read state of a ring without nodes
+var emptySnapshot = &ringSnapshot{}
+
+// ringSnapshot: immutable read state of a ring, replaced as a whole after
+// each change so that lookups need no lock
+// sortedRing: sorted hashes of the cubes, shared with the ring
+// nodes:      real nodes of the cubes, nodes[i] owns sortedRing[i]
+// members:    number of real nodes
+// inclusive:  a hash equal to a cube belongs to that cube
+// version:    number of snapshots published by the ring, see lookupCache
+// space:      number of positions of the keyspace, 2^keyBits of the ring
+// hashFunc:   hash function of the ring, nil means CRC32-IEEE
+// seed:       salt of every hash of the ring
+// keyBits:    width of the hashes of the ring, 0 means 32
+type ringSnapshot struct {
+	sortedRing uintArray
+	nodes      []string
+	members    int
+	inclusive  bool
+	version    uint64
+	space      uint64
+	hashFunc   HashFunc
+	seed       uint32
+	keyBits    int
+}
+
+// hash: position of name on the ring the snapshot was taken of
+func (s *ringSnapshot) hash(name string) uint32 {
+	return hashWith(s.hashFunc, s.seed, s.keyBits, []byte(name))
+}
+
+// hashBytes: see hash
+func (s *ringSnapshot) hashBytes(data []byte) uint32 {
+	return hashWith(s.hashFunc, s.seed, s.keyBits, data)
+}
+
+// RingView is an immutable point-in-time view of a HashRing, lookups on it
+// take no lock and do not see later changes of the ring
+type RingView struct {
+	snapshot *ringSnapshot
+}
+
+// Snapshot returns a view of the current state of the ring. Published
+// state is never modified, so taking a view copies nothing.
+func (r *HashRing) Snapshot() *RingView {
+	return &RingView{snapshot: r.loadSnapshot()}
+}
+
+// Len returns the number of virtual cubes of the view
+func (v *RingView) Len() int {
+	return len(v.snapshot.sortedRing)
+}
+
+// Lookup returns the node owning hash, "" if the view is empty
+func (v *RingView) Lookup(hash uint32) string {
+	s := v.snapshot
+	if len(s.sortedRing) == 0 {
+		return ""
+	}
+	return s.nodes[s.search(hash)]
+}
+
+// Version returns the version of the ring the view was taken at, a view is
+// stale once it differs from the Version of the ring
+func (v *RingView) Version() uint64 {
+	return v.snapshot.version
+}
+
+// GetNode returns the node of name like HashRing.GetNode did at the time
+// of the view
+func (v *RingView) GetNode(name string) (string, error) {
+	if len(v.snapshot.sortedRing) == 0 {
+		return "", ErrEmptyRing
+	}
+	return v.Lookup(v.snapshot.hash(name)), nil
+}
+
+// Version returns a number increased by every change of the ring, so that
+// callers can tell whether results computed at an earlier version are
+// still valid. Lookups do not change it.
+func (r *HashRing) Version() uint64 {
+	return r.loadSnapshot().version
+}
+
+// publish: replace the snapshot by the current state without the disabled
+// cubes, the caller holds the lock
+func (r *HashRing) publish() {
+	sortedRing := r.sortedRing
+	if len(r.disabled) > 0 {
+		sortedRing = make(uintArray, 0, len(r.sortedRing))
+		for _, hash := range r.sortedRing {
+			if !r.disabled[hash] {
+				sortedRing = append(sortedRing, hash)
+			}
+		}
+	}
+	r.snapshot.Store(&ringSnapshot{
+		sortedRing: sortedRing,
+		nodes:      r.ringNodes(sortedRing),
+		members:    len(r.members),
+		inclusive:  r.inclusive,
+		version:    r.loadSnapshot().version + 1,
+		space:      r.space(),
+		hashFunc:   r.hashFunc,
+		seed:       r.seed,
+		keyBits:    r.keyBits,
+	})
+}
+
+// loadSnapshot: the latest published snapshot, empty for a nil ring
+func (r *HashRing) loadSnapshot() *ringSnapshot {
+	if r == nil {
+		return emptySnapshot
+	}
+	if s := r.snapshot.Load(); s != nil {
+		return s
+	}
+	return emptySnapshot
+}
+
+// search: find the cube of key's hash value clockwise
+func (s *ringSnapshot) search(key uint32) (index int) {
+	compareFunc := func(x int) bool {
+		return s.sortedRing[x] > key
+	}
+	if s.inclusive {
+		compareFunc = func(x int) bool {
+			return s.sortedRing[x] >= key
+		}
+	}
+	index = sort.Search(len(s.sortedRing), compareFunc)
+	if index >= len(s.sortedRing) {
+		index = 0
+	}
+	return
+}
+
+// getNodes: the n closest distinct real nodes to the hash key
+func (s *ringSnapshot) getNodes(key uint32, n int) (nodes []string) {
+	return s.distinctNodesFrom(s.search(key), n, nil)
+}
+
+// getNodesLimited: getNodes visiting at most maxProbe cubes, 0 means no limit
+func (s *ringSnapshot) getNodesLimited(key uint32, n int, maxProbe int) (nodes []string) {
+	return s.distinctNodesLimited(s.search(key), n, maxProbe, nil)
+}
+
+// distinctNodesFrom: up to n distinct real nodes clockwise from the
+// index-th cube. skip, if not nil, is called once per distinct node in walk
+// order until n nodes are kept, and the nodes it reports are left out.
+func (s *ringSnapshot) distinctNodesFrom(index, n int, skip func(node string) bool) []string {
+	return s.distinctNodesLimited(index, n, 0, skip)
+}
+
+// distinctNodesLimited: distinctNodesFrom visiting at most maxProbe cubes,
+// 0 means no limit
+func (s *ringSnapshot) distinctNodesLimited(index, n, maxProbe int, skip func(node string) bool) []string {
+	return s.distinctNodesInto(nil, index, n, maxProbe, skip)
+}
+
+// distinctNodesInto: distinctNodesLimited appending the nodes to dst
+func (s *ringSnapshot) distinctNodesInto(dst []string, index, n, maxProbe int, skip func(node string) bool) []string {
+	if s.members < n {
+		n = s.members
+	}
+
+	w := s.walker(index)
+	w.limit = maxProbe
+	for found := 0; found < n; {
+		node, ok := w.next()
+		if !ok {
+			break
+		}
+		if skip == nil || !skip(node) {
+			dst = append(dst, node)
+			found++
+		}
+	}
+	return dst
+}
+
+// walker: create a ringWalker starting at the start-th cube
+func (s *ringSnapshot) walker(start int) *ringWalker {
+	return &ringWalker{snapshot: s, start: start, i: start, seen: make(map[string]struct{})}
+}
+
+// ringWalker visits the distinct real nodes of a snapshot clockwise,
+// starting at the start-th cube until it comes back to it, has found
+// every real node or has visited limit cubes
+type ringWalker struct {
+	snapshot *ringSnapshot
+	start    int
+	i        int
+	done     bool
+	seen     map[string]struct{}
+	probes   int
+	limit    int
+}
+
+// next: return the next distinct node, false when the walk is over
+func (w *ringWalker) next() (string, bool) {
+	s := w.snapshot
+	for !w.done && len(w.seen) < s.members && (w.limit <= 0 || w.probes < w.limit) {
+		w.probes++
+		node := s.nodes[w.i]
+		if w.i++; w.i >= len(s.sortedRing) {
+			w.i = 0
+		}
+		if w.i == w.start {
+			w.done = true
+		}
+		if _, ok := w.seen[node]; !ok {
+			w.seen[node] = struct{}{}
+			return node, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,126 @@
+package consistentHash
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func TestHashRing_Snapshot(t *testing.T) {
+	r := NewHashRing(WithSeed(7))
+	empty := r.Snapshot()
+	r.AddNodes(map[string]int{"192.168.1.1": 1, "192.168.1.2": 1, "192.168.1.3": 1})
+
+	view := r.Snapshot()
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := "key" + strconv.Itoa(i)
+		before[key], _ = r.GetNode(key)
+		if node, _ := view.GetNode(key); node != before[key] {
+			t.Fatal("key", key, "got", node, ", expected", before[key])
+		}
+		if node := view.Lookup(r.generateHash(key)); node != before[key] {
+			t.Fatal("lookup", key, "got", node, ", expected", before[key])
+		}
+	}
+
+	r.RemoveNode("192.168.1.1")
+	r.AddNode("192.168.1.4", 3)
+	checkEqual(view.Len(), 3*DefaultVirtualCubes, t)
+	for key, node := range before {
+		if got, _ := view.GetNode(key); got != node {
+			t.Fatal("key", key, "got", got, "after a change, expected", node)
+		}
+	}
+
+	checkEqual(empty.Len(), 0, t)
+	if empty.Lookup(0) != "" {
+		t.Error("lookup on an empty view got", empty.Lookup(0))
+	}
+	if _, err := empty.GetNode("key"); err == nil {
+		t.Error("expected an error on an empty view")
+	}
+}
+
+func TestRingSnapshot_DistinctNodesFrom(t *testing.T) {
+	s := &ringSnapshot{
+		sortedRing: uintArray{10, 20, 30, 40, 50, 60},
+		nodes:      []string{"a", "a", "b", "a", "c", "b"},
+		members:    3,
+	}
+	for _, c := range []struct {
+		index, n int
+		nodes    string
+	}{
+		{0, 3, "[a b c]"},
+		{4, 3, "[c b a]"},
+		{5, 3, "[b a c]"},
+		{3, 2, "[a c]"},
+		{1, 10, "[a b c]"},
+		{2, 0, "[]"},
+	} {
+		if got := fmt.Sprint(s.distinctNodesFrom(c.index, c.n, nil)); got != c.nodes {
+			t.Error("from", c.index, "n", c.n, "got", got, ", expected", c.nodes)
+		}
+	}
+
+	// skip sees each distinct node once, in walk order, until n are kept
+	var seen []string
+	got := s.distinctNodesFrom(5, 1, func(node string) bool {
+		seen = append(seen, node)
+		return node != "c"
+	})
+	if fmt.Sprint(got) != "[c]" || fmt.Sprint(seen) != "[b a c]" {
+		t.Error("got", got, "after skipping", seen)
+	}
+	got = s.distinctNodesFrom(0, 3, func(node string) bool { return true })
+	checkEqual(len(got), 0, t)
+
+	// the walk stops once every member is found
+	probes := 0
+	w := s.walker(0)
+	for _, ok := w.next(); ok; _, ok = w.next() {
+		probes++
+	}
+	checkEqual(probes, 3, t)
+	checkEqual(w.probes, 5, t)
+
+	checkEqual(len(emptySnapshot.distinctNodesFrom(0, 3, nil)), 0, t)
+}
+
+func TestHashRing_Version(t *testing.T) {
+	r := NewHashRing()
+	v := r.Version()
+	r.AddNode("192.168.1.1", 1)
+	if r.Version() <= v {
+		t.Error("AddNode kept version", v)
+	}
+	view := r.Snapshot()
+
+	v = r.Version()
+	r.GetNode("key1")
+	r.GetNodes("key1", 2)
+	r.Members()
+	r.RemoveNode("192.168.1.9")
+	r.RemoveNodes([]string{"192.168.1.9"})
+	r.RemoveByPrefix("10.")
+	r.AddNode("192.168.1.1", 1)
+	r.AddNodes(map[string]int{"192.168.1.1": 1})
+	r.AddNodesStaged(map[string]int{"192.168.1.1": 1})
+	r.ReplaceAllNodes(map[string]int{"192.168.1.1": 1})
+	if r.Version() != v {
+		t.Error("version went from", v, "to", r.Version(), "without change")
+	}
+	if view.Version() != v {
+		t.Error("view version", view.Version(), ", expected", v)
+	}
+
+	r.AddNode("192.168.1.2", 1)
+	r.RemoveNode("192.168.1.2")
+	if r.Version() <= v {
+		t.Error("AddNode and RemoveNode kept version", v)
+	}
+	if view.Version() == r.Version() {
+		t.Error("expected the view to be stale")
+	}
+}
@@ -0,0 +1,396 @@
+package consistentHash
+
+import (
+	"math"
+	"sort"
+)
+
+// keyspace is the number of distinct positions on the 32-bit ring
+const keyspace = uint64(1) << 32
+
+// space: number of positions hashes of the ring land in, 2^keyBits
+func (r *HashRing) space() uint64 {
+	if r.keyBits > 0 && r.keyBits < 32 {
+		return uint64(1) << r.keyBits
+	}
+	return keyspace
+}
+
+// RemapStats describes a change of ownership on the ring
+// Moved:    number of hash values whose owner changed
+// Fraction: Moved as a fraction of the keyspace of the ring
+type RemapStats struct {
+	Moved    uint64
+	Fraction float64
+}
+
+// remapStats: count the hash values whose owner differs before and after
+// a change. Inclusive search shifts every arc by one, which does not
+// change the result.
+func remapStats(old, new *ringSnapshot) RemapStats {
+	var moved uint64
+	space := diffArcs(old, new, func(start, end uint64, from, to string) {
+		moved += end - start
+	})
+	if moved == 0 {
+		return RemapStats{}
+	}
+	return RemapStats{Moved: moved, Fraction: float64(moved) / float64(space)}
+}
+
+// diffArcs: call fn for each arc [start, end) of the keyspace whose owner
+// differs between old and new, the owner of an empty ring is "".
+// Return the size of the keyspace of the rings.
+// A hash value is owned by the first point greater than it, so ownership
+// only changes at points of either ring and each gap between two
+// consecutive points of the merged rings has a single owner on both sides.
+func diffArcs(old, new *ringSnapshot, fn func(start, end uint64, from, to string)) (space uint64) {
+	oldRing, newRing := old.sortedRing, new.sortedRing
+	if len(oldRing) == 0 && len(newRing) == 0 {
+		return 0
+	}
+	// a ring which never published has no keyspace
+	space = max(old.space, new.space)
+
+	var pos uint64
+	i, j := 0, 0
+	for pos < space {
+		for i < len(oldRing) && uint64(oldRing[i]) <= pos {
+			i++
+		}
+		for j < len(newRing) && uint64(newRing[j]) <= pos {
+			j++
+		}
+		next := space
+		if i < len(oldRing) && uint64(oldRing[i]) < next {
+			next = uint64(oldRing[i])
+		}
+		if j < len(newRing) && uint64(newRing[j]) < next {
+			next = uint64(newRing[j])
+		}
+		from, to := "", ""
+		if len(oldRing) > 0 {
+			from = old.nodes[i%len(oldRing)]
+		}
+		if len(newRing) > 0 {
+			to = new.nodes[j%len(newRing)]
+		}
+		if from != to {
+			fn(pos, next, from, to)
+		}
+		pos = next
+	}
+	return space
+}
+
+// Move is an arc of the keyspace changing owner
+// Start, End: the arc [Start, End), wrapping like the ranges of Ranges
+// From, To:   owner before and after, "" for a ring without nodes
+type Move struct {
+	Start uint32
+	End   uint32
+	From  string
+	To    string
+}
+
+// MigrationPlan returns the arcs of the keyspace which would change owner
+// if the nodes of the ring were replaced by target like ReplaceAllNodes.
+// Adjacent arcs with the same owners are merged, arcs come in ascending
+// order but for one wrapping around which comes first. The ring itself is
+// not modified.
+func (r *HashRing) MigrationPlan(target map[string]int) ([]Move, error) {
+	if r == nil {
+		return nil, ErrNotInitialized
+	}
+	c := r.Clone()
+	c.logger = nil
+	old := c.loadSnapshot()
+	if err := c.ReplaceAllNodes(target); err != nil {
+		return nil, err
+	}
+
+	// the end of the keyspace is written 0, like in Ranges
+	var moves []Move
+	space := c.space()
+	diffArcs(old, c.loadSnapshot(), func(start, end uint64, from, to string) {
+		if k := len(moves) - 1; k >= 0 && uint64(moves[k].End) == start && moves[k].From == from && moves[k].To == to {
+			moves[k].End = uint32(end % space)
+			return
+		}
+		moves = append(moves, Move{Start: uint32(start), End: uint32(end % space), From: from, To: to})
+	})
+	// join the arc ending at the end of the keyspace with the one starting at 0
+	if k := len(moves) - 1; k > 0 && moves[k].End == 0 && moves[0].Start == 0 &&
+		moves[k].From == moves[0].From && moves[k].To == moves[0].To {
+		moves[0].Start = moves[k].Start
+		moves = moves[:k]
+	}
+	if old.inclusive {
+		for i := range moves {
+			moves[i].Start = uint32((uint64(moves[i].Start) + 1) % space)
+			moves[i].End = uint32((uint64(moves[i].End) + 1) % space)
+		}
+	}
+	return moves, nil
+}
+
+// EstimateRemap returns how many of keys would change owner if ip were
+// added with weight, the ring itself is not modified. Nodes rejected by
+// AddNode are rejected with the same error.
+func (r *HashRing) EstimateRemap(ip string, weight int, keys []string) (int, error) {
+	if r == nil {
+		return 0, ErrNotInitialized
+	}
+	c := r.Clone()
+	c.logger = nil
+	if err := c.checkNode(ip, weight); err != nil {
+		return 0, err
+	}
+	c.addNode(ip, c.scaledWeight(weight), c.nodeCubes(ip))
+
+	moved := 0
+	for _, key := range keys {
+		before, _ := r.GetNode(key)
+		after, _ := c.GetNode(key)
+		if before != after {
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// Distribution returns each node's share of the keyspace, computed from
+// the arc lengths between consecutive cubes of the ring
+func (r *HashRing) Distribution() map[string]float64 {
+	if r == nil {
+		return map[string]float64{}
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.distribution()
+}
+
+// NodeShare is the share of the keyspace owned by a node
+type NodeShare struct {
+	Node  string
+	Share float64
+}
+
+// NodesByLoad returns the share of the keyspace of every node like
+// Distribution, from the largest share to the smallest, ties in node order
+func (r *HashRing) NodesByLoad() []NodeShare {
+	if r == nil {
+		return nil
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	shares := r.distribution()
+	nodes := make([]NodeShare, 0, len(r.members))
+	for ip := range r.members {
+		nodes = append(nodes, NodeShare{Node: ip, Share: shares[ip]})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Share != nodes[j].Share {
+			return nodes[i].Share > nodes[j].Share
+		}
+		return nodes[i].Node < nodes[j].Node
+	})
+	return nodes
+}
+
+// distribution: see Distribution, the caller holds the lock
+func (r *HashRing) distribution() map[string]float64 {
+	space := r.space()
+	arcs := make(map[string]uint64)
+	for i, hash := range r.sortedRing {
+		arcs[r.ring[hash]] += arcLength(r.sortedRing, i, space)
+	}
+	shares := make(map[string]float64, len(arcs))
+	for node, arc := range arcs {
+		shares[node] = float64(arc) / float64(space)
+	}
+	return shares
+}
+
+// arcLength: number of hash values owned by the i-th cube of a sorted ring
+// over a keyspace of space positions
+func arcLength(sortedRing uintArray, i int, space uint64) uint64 {
+	if len(sortedRing) == 1 {
+		return space
+	}
+	if i == 0 {
+		return space - uint64(sortedRing[len(sortedRing)-1]) + uint64(sortedRing[0])
+	}
+	return uint64(sortedRing[i] - sortedRing[i-1])
+}
+
+// Ranges returns the arcs of the keyspace owned by ip as half-open
+// [start, end) intervals, adjacent arcs are merged. With inclusive search
+// the arcs are shifted by one. A range whose start is
+// not below its end wraps around from the end of the keyspace to 0, and
+// start == end means the whole keyspace. Unknown nodes have no range.
+func (r *HashRing) Ranges(ip string) [][2]uint32 {
+	s := r.loadSnapshot()
+	n := len(s.sortedRing)
+
+	var ranges [][2]uint32
+	for i, node := range s.nodes {
+		if node != ip {
+			continue
+		}
+		start, end := s.sortedRing[(i+n-1)%n], s.sortedRing[i]
+		if s.inclusive {
+			start = uint32((uint64(start) + 1) % s.space)
+			end = uint32((uint64(end) + 1) % s.space)
+		}
+		if k := len(ranges) - 1; k >= 0 && ranges[k][1] == start {
+			ranges[k][1] = end
+		} else {
+			ranges = append(ranges, [2]uint32{start, end})
+		}
+	}
+	// join the arc ending at the first cube with the one wrapping to it
+	if k := len(ranges) - 1; k > 0 && ranges[k][1] == ranges[0][0] {
+		ranges[0][0] = ranges[k][0]
+		ranges = ranges[:k]
+	}
+	return ranges
+}
+
+// Histogram divides the keyspace into buckets equal segments and counts the
+// cubes in each, a flat histogram means the hash spreads cubes evenly.
+// A non-positive buckets returns nil.
+func (r *HashRing) Histogram(buckets int) []int {
+	if buckets <= 0 {
+		return nil
+	}
+	if r == nil {
+		return make([]int, buckets)
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	space := r.space()
+	counts := make([]int, buckets)
+	for _, hash := range r.sortedRing {
+		counts[uint64(hash)*uint64(buckets)/space]++
+	}
+	return counts
+}
+
+// RingStats is a summary of the state of a ring, e.g. for metrics
+// Members:      number of real nodes
+// VirtualNodes: number of virtual cubes on the ring
+// Collisions:   number of virtual cubes lost to hash collisions
+// MaxLoadShare: largest share of the keyspace owned by a node
+// MinLoadShare: smallest share of the keyspace owned by a node
+type RingStats struct {
+	Members      int
+	VirtualNodes int
+	Collisions   int
+	MaxLoadShare float64
+	MinLoadShare float64
+}
+
+// Stats returns a summary of the ring, the shares are 0 on an empty ring
+func (r *HashRing) Stats() RingStats {
+	if r == nil {
+		return RingStats{}
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	stats := RingStats{
+		Members:      len(r.members),
+		VirtualNodes: len(r.ring),
+		Collisions:   r.intendedCubes() - len(r.ring),
+	}
+	shares := r.distribution()
+	first := true
+	for ip := range r.members {
+		share := shares[ip]
+		if first || share > stats.MaxLoadShare {
+			stats.MaxLoadShare = share
+		}
+		if first || share < stats.MinLoadShare {
+			stats.MinLoadShare = share
+		}
+		first = false
+	}
+	return stats
+}
+
+// CollisionCount returns how many of the intended virtual cubes were lost
+// because their hash collides with another cube of the ring
+func (r *HashRing) CollisionCount() int {
+	if r == nil {
+		return 0
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.intendedCubes() - len(r.ring)
+}
+
+// VirtualNodeCount returns the number of virtual cubes on the ring
+func (r *HashRing) VirtualNodeCount() int {
+	if r == nil {
+		return 0
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	return len(r.ring)
+}
+
+// RingSize returns the number of cubes lookups currently see, like
+// VirtualNodeCount but without taking the lock, 0 means lookups fail
+func (r *HashRing) RingSize() int {
+	return len(r.loadSnapshot().sortedRing)
+}
+
+// IntendedVirtualNodeCount returns the number of virtual cubes the nodes
+// would have without collisions: the sum of cubes per weight times weight
+func (r *HashRing) IntendedVirtualNodeCount() int {
+	if r == nil {
+		return 0
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.intendedCubes()
+}
+
+// intendedCubes: sum of the cubes of every node, the caller holds the lock
+func (r *HashRing) intendedCubes() (intended int) {
+	for ip, weight := range r.weights {
+		intended += r.cubes[ip] * weight
+	}
+	return
+}
+
+// SuggestCubes returns the number of virtual cubes per node keeping the
+// standard deviation of the load of numNodes nodes of weight 1 around
+// targetStdDev, as a fraction of the average load, e.g. 0.1 for 10%.
+// With n nodes of c uniformly hashed cubes, a node owns c of the n*c arcs
+// of the ring and the relative variance of its load is (n-1)/(n*c+1).
+// It returns 1 for a single node and 0 if targetStdDev is not positive.
+func SuggestCubes(numNodes int, targetStdDev float64) int {
+	if !(targetStdDev > 0) {
+		return 0
+	}
+	if numNodes <= 1 {
+		return 1
+	}
+	n := float64(numNodes)
+	cubes := math.Ceil(((n-1)/(targetStdDev*targetStdDev) - 1) / n)
+	if cubes < 1 {
+		return 1
+	}
+	if cubes >= math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(cubes)
+}
@@ -0,0 +1,444 @@
+package consistentHash
+
+import (
+	"fmt"
+	"hash/crc32"
+	"math"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// tableHash: hash function placing the listed keys at fixed positions
+func tableHash(points map[string]uint32) HashFunc {
+	return func(data []byte) uint32 {
+		if hash, ok := points[string(data)]; ok {
+			return hash
+		}
+		return crc32.ChecksumIEEE(data)
+	}
+}
+
+func TestHashRing_RemapStats(t *testing.T) {
+	r := NewHashRing(WithHashFunc(tableHash(map[string]uint32{
+		"a#0": 1000,
+		"b#0": 3000,
+		"c#0": 2000,
+		"c#1": 4000,
+	})))
+	r.SetCubeNumber(1)
+
+	stats, _ := r.AddNodeStats("a", 1)
+	if stats.Moved != keyspace || stats.Fraction != 1 {
+		t.Error("first node should take the whole keyspace, got", stats)
+	}
+	r.AddNode("b", 1)
+
+	// c takes [1000, 2000) from b
+	stats, _ = r.AddNodeStats("c", 1)
+	if stats.Moved != 1000 {
+		t.Error("add: moved", stats.Moved, ", expected", 1000)
+	}
+	if stats.Fraction != 1000/float64(keyspace) {
+		t.Error("add: fraction", stats.Fraction, ", expected", 1000/float64(keyspace))
+	}
+
+	// c at weight 2 also takes [3000, 4000) from a
+	r.RemoveNode("c")
+	stats, _ = r.AddNodeStats("c", 2)
+	if stats.Moved != 2000 {
+		t.Error("add weight 2: moved", stats.Moved, ", expected", 2000)
+	}
+
+	stats = r.RemoveNodeStats("c")
+	if stats.Moved != 2000 {
+		t.Error("remove: moved", stats.Moved, ", expected", 2000)
+	}
+
+	// a owns [3000, 2^32) and [0, 1000)
+	stats = r.RemoveNodeStats("a")
+	if stats.Moved != keyspace-2000 {
+		t.Error("remove: moved", stats.Moved, ", expected", keyspace-2000)
+	}
+}
+
+func TestHashRing_EstimateRemap(t *testing.T) {
+	r := NewHashRing()
+	for i := 1; i <= 4; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i), 1)
+	}
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+
+	low, err := r.EstimateRemap("192.168.1.5", 1, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	high, err := r.EstimateRemap("192.168.1.5", 8, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if low == 0 || high <= low {
+		t.Error("moved keys got", low, "for weight 1 and", high, "for weight 8")
+	}
+	checkEqual(r.NodeCount(), 4, t)
+	checkEqual(len(r.sortedRing), 4*DefaultVirtualCubes, t)
+
+	// the estimate is the number of keys moved by the actual change
+	before := make([]string, len(keys))
+	for i, key := range keys {
+		before[i], _ = r.GetNode(key)
+	}
+	r.AddNode("192.168.1.5", 8)
+	moved := 0
+	for i, key := range keys {
+		if node, _ := r.GetNode(key); node != before[i] {
+			moved++
+		}
+	}
+	checkEqual(moved, high, t)
+
+	// invalid nodes are rejected like by AddNode
+	for _, c := range []struct {
+		ip     string
+		weight int
+	}{
+		{"192.168.1.6", math.MaxInt / 2},
+		{"", 1},
+		{" 192.168.1.6", 1},
+	} {
+		if n, err := r.EstimateRemap(c.ip, c.weight, keys); err == nil || n != 0 {
+			t.Error("node", c.ip, "of weight", c.weight, "got", n, err, ", expected an error")
+		}
+	}
+}
+
+func TestHashRing_Distribution(t *testing.T) {
+	r := NewHashRing()
+	checkEqual(len(r.Distribution()), 0, t)
+
+	r.AddNode("192.168.1.1", 1)
+	if share := r.Distribution()["192.168.1.1"]; share != 1 {
+		t.Error("single node share is", share, ", expected 1")
+	}
+
+	for i := 2; i <= 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i), 1)
+	}
+	r.AddNode("192.168.1.100", 10)
+
+	shares := r.Distribution()
+	checkEqual(len(shares), 11, t)
+	sum := 0.0
+	for _, share := range shares {
+		sum += share
+	}
+	if math.Abs(sum-1) > 1e-9 {
+		t.Error("shares sum to", sum, ", expected 1")
+	}
+	for i := 1; i <= 10; i++ {
+		ip := "192.168.1." + strconv.Itoa(i)
+		if shares["192.168.1.100"] < 3*shares[ip] {
+			t.Error("weight 10 node share", shares["192.168.1.100"], "is not much larger than", ip, shares[ip])
+		}
+	}
+}
+
+func TestHashRing_Ranges(t *testing.T) {
+	r := NewHashRing(WithHashFunc(tableHash(map[string]uint32{
+		"a#0": 1000,
+		"a#1": 2000,
+		"b#0": 3000,
+		"b#1": 4000,
+	})))
+	r.SetCubeNumber(2)
+	r.AddNode("a", 1)
+	if ranges := r.Ranges("a"); len(ranges) != 1 || ranges[0][0] != ranges[0][1] {
+		t.Error("single node should own the whole keyspace, got", ranges)
+	}
+
+	r.AddNode("b", 1)
+	ranges := r.Ranges("a")
+	if len(ranges) != 1 || ranges[0] != [2]uint32{4000, 2000} {
+		t.Error("a: got", ranges, ", expected [[4000 2000]]")
+	}
+	ranges = r.Ranges("b")
+	if len(ranges) != 1 || ranges[0] != [2]uint32{2000, 4000} {
+		t.Error("b: got", ranges, ", expected [[2000 4000]]")
+	}
+	if r.Ranges("c") != nil {
+		t.Error("expected no range for an unknown node")
+	}
+}
+
+func TestHashRing_RangesCoverKeyspace(t *testing.T) {
+	r := NewHashRing()
+	for i := 0; i < 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i+1), i+1)
+	}
+
+	var all [][2]uint32
+	var total uint64
+	for _, ip := range r.Members() {
+		for _, rg := range r.Ranges(ip) {
+			all = append(all, rg)
+			total += uint64(rg[1] - rg[0])
+
+			s := r.loadSnapshot()
+			if owner := s.nodes[s.search(rg[0])]; owner != ip {
+				t.Error("range", rg, "of", ip, "starts in an arc of", owner)
+			}
+		}
+	}
+	if total != keyspace {
+		t.Error("ranges cover", total, "hash values, expected", keyspace)
+	}
+
+	// tiling: each range ends where another one starts
+	sort.Slice(all, func(i, j int) bool { return all[i][0] < all[j][0] })
+	for i := range all {
+		if all[i][1] != all[(i+1)%len(all)][0] {
+			t.Fatal("gap or overlap after range", all[i])
+		}
+	}
+}
+
+func TestHashRing_CollisionCount(t *testing.T) {
+	r := NewHashRing()
+	r.AddNode("192.168.1.1", 1)
+	r.AddNode("192.168.1.2", 2)
+	checkEqual(r.CollisionCount(), 0, t)
+
+	// 1280 cubes hashed into 1000 positions must collide
+	r = NewHashRing(WithHashFunc(func(data []byte) uint32 {
+		return crc32.ChecksumIEEE(data) % 1000
+	}))
+	for i := 0; i < 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i+1), 1)
+	}
+	collisions := r.CollisionCount()
+	if collisions < 280 {
+		t.Error("expected at least 280 collisions, got", collisions)
+	}
+	checkEqual(len(r.ring)+collisions, 10*DefaultVirtualCubes, t)
+}
+
+func TestHashRing_VirtualNodeCount(t *testing.T) {
+	r := NewHashRing(WithVirtualCubes(10))
+	r.AddNode("192.168.1.1", 1)
+	r.AddNode("192.168.1.2", 3)
+	r.AddNodeWithCubes("192.168.1.3", 2, 5)
+	checkEqual(r.IntendedVirtualNodeCount(), 10*(1+3)+5*2, t)
+	checkEqual(r.VirtualNodeCount(), len(r.ring), t)
+
+	r = NewHashRing(WithHashFunc(func(data []byte) uint32 {
+		return crc32.ChecksumIEEE(data) % 100
+	}))
+	r.AddNode("192.168.1.1", 1)
+	r.AddNode("192.168.1.2", 2)
+	checkEqual(r.IntendedVirtualNodeCount(), 3*DefaultVirtualCubes, t)
+	if r.VirtualNodeCount() > 100 {
+		t.Error("got", r.VirtualNodeCount(), "cubes in 100 positions")
+	}
+	checkEqual(r.IntendedVirtualNodeCount()-r.VirtualNodeCount(), r.CollisionCount(), t)
+}
+
+func TestHashRing_Histogram(t *testing.T) {
+	r := NewHashRing(WithHashFunc(tableHash(map[string]uint32{
+		"a#0": 0,
+		"a#1": 1<<30 - 1,
+		"a#2": 1 << 30,
+		"a#3": 1<<32 - 1,
+	})), WithVirtualCubes(4))
+	r.AddNode("a", 1)
+	if got := fmt.Sprint(r.Histogram(4)); got != "[2 1 0 1]" {
+		t.Error("got", got, ", expected [2 1 0 1]")
+	}
+	if r.Histogram(0) != nil {
+		t.Error("no bucket got", r.Histogram(0))
+	}
+
+	r = NewHashRing(WithHashFunc(Murmur3Hash))
+	for i := 1; i <= 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i), 1)
+	}
+	sum := 0
+	for _, count := range r.Histogram(16) {
+		sum += count
+	}
+	checkEqual(sum, len(r.sortedRing), t)
+}
+
+func TestHashRing_Stats(t *testing.T) {
+	if stats := NewHashRing().Stats(); stats != (RingStats{}) {
+		t.Error("empty ring got", stats)
+	}
+
+	r := NewHashRing(WithHashFunc(tableHash(map[string]uint32{
+		"a#0": 1 << 30,
+		"b#0": 1 << 31,
+		"b#1": 3 << 30,
+		"c#0": 1<<31 + 1<<30 + 1<<29,
+	})), WithVirtualCubes(1))
+	r.AddNode("a", 1)
+	r.AddNode("b", 2)
+	r.AddNode("c", 1)
+
+	stats := r.Stats()
+	checkEqual(stats.Members, 3, t)
+	checkEqual(stats.VirtualNodes, 4, t)
+	checkEqual(stats.Collisions, 0, t)
+	// b owns [a#0, b#1), c owns [b#1, c#0)
+	if stats.MaxLoadShare != 0.5 || stats.MinLoadShare != 0.125 {
+		t.Error("got shares", stats.MaxLoadShare, stats.MinLoadShare, ", expected 0.5 0.125")
+	}
+}
+
+func TestHashRing_RangesInclusive(t *testing.T) {
+	r := NewHashRing(WithInclusiveSearch(true), WithHashFunc(tableHash(map[string]uint32{
+		"a#0": 1000,
+		"b#0": 3000,
+	})))
+	r.SetCubeNumber(1)
+	r.AddNode("a", 1)
+	r.AddNode("b", 1)
+	if ranges := r.Ranges("b"); len(ranges) != 1 || ranges[0] != [2]uint32{1001, 3001} {
+		t.Error("b: got", ranges, ", expected [[1001 3001]]")
+	}
+}
+
+func TestHashRing_MigrationPlan(t *testing.T) {
+	r := NewHashRing(WithHashFunc(tableHash(map[string]uint32{
+		"a#0": 1000,
+		"b#0": 3000,
+		"c#0": 2000,
+	})))
+	r.SetCubeNumber(1)
+	r.AddNodes(map[string]int{"a": 1, "b": 1})
+
+	moves, err := r.MigrationPlan(map[string]int{"a": 1, "b": 1, "c": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(moves) != "[{1000 2000 b c}]" {
+		t.Error("got", moves, ", expected [{1000 2000 b c}]")
+	}
+	checkEqual(r.NodeCount(), 2, t)
+
+	moves, _ = r.MigrationPlan(map[string]int{"b": 1})
+	if fmt.Sprint(moves) != "[{3000 1000 a b}]" {
+		t.Error("got", moves, ", expected [{3000 1000 a b}]")
+	}
+	if _, err := r.MigrationPlan(map[string]int{"": 1}); err == nil {
+		t.Error("expected an error for an empty node id")
+	}
+}
+
+func TestHashRing_MigrationPlanAdd(t *testing.T) {
+	r := NewHashRing()
+	target := make(map[string]int)
+	for i := 1; i <= 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i), i%3+1)
+		target["192.168.1."+strconv.Itoa(i)] = i%3 + 1
+	}
+	target["192.168.1.11"] = 2
+	moves, err := r.MigrationPlan(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the plan is exactly the arcs of the new node
+	after := r.Clone()
+	after.AddNode("192.168.1.11", 2)
+	var arcs [][2]uint32
+	for _, move := range moves {
+		if move.To != "192.168.1.11" {
+			t.Error("arc", move, "does not move to the new node")
+		}
+		if owner, _ := r.GetNodeForHash(move.Start); owner != move.From {
+			t.Error("arc", move, "is owned by", owner)
+		}
+		arcs = append(arcs, [2]uint32{move.Start, move.End})
+	}
+	if fmt.Sprint(arcs) != fmt.Sprint(after.Ranges("192.168.1.11")) {
+		t.Error("got arcs", arcs, ", expected", after.Ranges("192.168.1.11"))
+	}
+}
+
+func TestHashRing_RingSize(t *testing.T) {
+	var nilRing *HashRing
+	checkEqual(nilRing.RingSize(), 0, t)
+	r := NewHashRing(WithVirtualCubes(10))
+	checkEqual(r.RingSize(), 0, t)
+	r.AddNodes(map[string]int{"192.168.1.1": 1, "192.168.1.2": 3})
+	checkEqual(r.RingSize(), 10*(1+3), t)
+
+	// 3 cubes in 2 positions
+	r = NewHashRing(WithVirtualCubes(1), WithHashFunc(tableHash(map[string]uint32{
+		"a#0": 1000, "b#0": 2000, "b#1": 1000,
+	})))
+	r.AddNode("a", 1)
+	r.AddNode("b", 2)
+	checkEqual(r.RingSize(), 1*(1+2)-r.CollisionCount(), t)
+	checkEqual(r.RingSize(), 2, t)
+	checkEqual(r.NodeCount(), 2, t)
+}
+
+func TestSuggestCubes(t *testing.T) {
+	checkEqual(SuggestCubes(10, 0.05), 360, t)
+	checkEqual(SuggestCubes(1, 0.01), 1, t)
+	checkEqual(SuggestCubes(10, 0), 0, t)
+	checkEqual(SuggestCubes(10, 10), 1, t)
+
+	last := 0
+	for _, target := range []float64{0.5, 0.2, 0.1, 0.05, 0.01} {
+		cubes := SuggestCubes(10, target)
+		if cubes <= last {
+			t.Error("target", target, "got", cubes, "cubes, not more than", last)
+		}
+		last = cubes
+	}
+
+	// the load of a ring built with the suggestion spreads as asked
+	r := NewHashRing(WithHashFunc(Murmur3Hash), WithVirtualCubes(SuggestCubes(50, 0.1)))
+	for i := 0; i < 50; i++ {
+		r.AddNode("10.0.0."+strconv.Itoa(i), 1)
+	}
+	variance := 0.0
+	for _, share := range r.Distribution() {
+		variance += (share*50 - 1) * (share*50 - 1) / 50
+	}
+	if stddev := math.Sqrt(variance); stddev > 0.15 {
+		t.Error("load stddev is", stddev, ", expected about 0.1")
+	}
+}
+
+func TestHashRing_NodesByLoad(t *testing.T) {
+	r := NewHashRing()
+	checkEqual(len(r.NodesByLoad()), 0, t)
+	for i := 1; i <= 10; i++ {
+		r.AddNode("192.168.1."+strconv.Itoa(i), i)
+	}
+
+	nodes := r.NodesByLoad()
+	checkEqual(len(nodes), 10, t)
+	shares := r.Distribution()
+	sum := 0.0
+	for i, node := range nodes {
+		if node.Share != shares[node.Node] {
+			t.Error(node.Node, "got share", node.Share, ", expected", shares[node.Node])
+		}
+		if node.Share > nodes[0].Share || (i > 0 && node.Share > nodes[i-1].Share) {
+			t.Error(node.Node, "share", node.Share, "is out of order")
+		}
+		sum += node.Share
+	}
+	if math.Abs(sum-1) > 1e-9 {
+		t.Error("shares sum to", sum, ", expected 1")
+	}
+	if nodes[0].Node != "192.168.1.10" {
+		t.Error("hottest node is", nodes[0].Node, ", expected 192.168.1.10")
+	}
+}
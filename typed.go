@@ -0,0 +1,97 @@
+package consistentHash
+
+import "sync"
+
+// TypedRing places nodes of any comparable type, e.g. structs describing
+// servers, on a HashRing, so callers need no side map from ids to nodes.
+// A node is placed by the string returned by the id function given to
+// NewTypedRing, which must be unique and stable for the node.
+// ring:  the underlying ring, holding the ids of the nodes
+// id:    id of a node on the ring
+// nodes: map, key is node id, value is the node
+type TypedRing[T comparable] struct {
+	ring  *HashRing
+	id    func(node T) string
+	nodes map[string]T
+	sync.RWMutex
+}
+
+// NewTypedRing creates a ring of nodes of type T identified by id,
+// the underlying HashRing is configured by opts
+func NewTypedRing[T comparable](id func(node T) string, opts ...Option) *TypedRing[T] {
+	return &TypedRing[T]{
+		ring:  NewHashRing(opts...),
+		id:    id,
+		nodes: make(map[string]T),
+	}
+}
+
+// AddNode: add a node, or replace the node with the same id and change its
+// weight. The errors are the ones of HashRing.AddNode for the id of node.
+func (r *TypedRing[T]) AddNode(node T, weight int) error {
+	r.Lock()
+	defer r.Unlock()
+
+	id := r.id(node)
+	if err := r.ring.AddNode(id, weight); err != nil {
+		return err
+	}
+	r.nodes[id] = node
+	return nil
+}
+
+// RemoveNode: remove the node with the id of node, return false if there
+// is none
+func (r *TypedRing[T]) RemoveNode(node T) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	id := r.id(node)
+	if !r.ring.RemoveNode(id) {
+		return false
+	}
+	delete(r.nodes, id)
+	return true
+}
+
+// GetNode returns the node of name like HashRing.GetNode
+func (r *TypedRing[T]) GetNode(name string) (T, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	id, err := r.ring.GetNode(name)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return r.nodes[id], nil
+}
+
+// GetNodes returns up to n distinct nodes for name like HashRing.GetNodes
+func (r *TypedRing[T]) GetNodes(name string, n int) ([]T, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	ids, err := r.ring.GetNodes(name, n)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]T, len(ids))
+	for i, id := range ids {
+		nodes[i] = r.nodes[id]
+	}
+	return nodes, nil
+}
+
+// Members returns the nodes of the ring in the order of their ids
+func (r *TypedRing[T]) Members() []T {
+	r.RLock()
+	defer r.RUnlock()
+
+	ids := r.ring.SortedMembers()
+	nodes := make([]T, len(ids))
+	for i, id := range ids {
+		nodes[i] = r.nodes[id]
+	}
+	return nodes
+}
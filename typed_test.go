@@ -0,0 +1,78 @@
+package consistentHash
+
+import (
+	"strconv"
+	"testing"
+)
+
+type testServer struct {
+	Host string
+	Port int
+	Zone string
+}
+
+func testServerID(s testServer) string {
+	return s.Host + ":" + strconv.Itoa(s.Port)
+}
+
+func TestTypedRing(t *testing.T) {
+	r := NewTypedRing(testServerID)
+	if _, err := r.GetNode("key1"); err != ErrEmptyRing {
+		t.Error("empty ring got", err, ", expected", ErrEmptyRing)
+	}
+
+	plain := NewHashRing()
+	servers := make(map[string]testServer)
+	for i := 1; i <= 5; i++ {
+		s := testServer{Host: "10.0.0." + strconv.Itoa(i), Port: 6379, Zone: "z" + strconv.Itoa(i%2)}
+		if err := r.AddNode(s, i); err != nil {
+			t.Fatal(err)
+		}
+		plain.AddNode(testServerID(s), i)
+		servers[testServerID(s)] = s
+	}
+	checkEqual(len(r.Members()), 5, t)
+
+	// nodes are placed like their ids on a plain ring
+	for i := 0; i < 1000; i++ {
+		key := "key" + strconv.Itoa(i)
+		node, err := r.GetNode(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := plain.GetNode(key)
+		if node != servers[id] {
+			t.Fatal(key, "got", node, ", expected", servers[id])
+		}
+	}
+	nodes, _ := r.GetNodes("key1", 3)
+	ids, _ := plain.GetNodes("key1", 3)
+	for i := range nodes {
+		if testServerID(nodes[i]) != ids[i] {
+			t.Error("got", nodes, ", expected", ids)
+		}
+	}
+
+	// a node with the same id replaces the old one
+	moved := testServer{Host: "10.0.0.1", Port: 6379, Zone: "z9"}
+	r.AddNode(moved, 1)
+	if members := r.Members(); members[0] != moved {
+		t.Error("got", members[0], ", expected", moved)
+	}
+
+	if !r.RemoveNode(moved) || r.RemoveNode(moved) {
+		t.Error("expected to remove 10.0.0.1 once")
+	}
+	for i := 0; i < 1000; i++ {
+		if node, _ := r.GetNode("key" + strconv.Itoa(i)); node.Host == "10.0.0.1" {
+			t.Fatal("got the removed node", node)
+		}
+	}
+	if err := r.AddNode(testServer{}, 1); err != nil {
+		t.Error("id \":0\" got", err)
+	}
+	if err := NewTypedRing(func(s testServer) string { return s.Host }).AddNode(testServer{}, 1); err == nil {
+		t.Error("expected an error for an empty id")
+	}
+	checkEqual(len(r.Members()), 5, t)
+}